@@ -2,7 +2,6 @@ package influxdbapi
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"internal/system_metrics"
 	"log"
@@ -11,6 +10,7 @@ import (
 	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	influxapi "github.com/influxdata/influxdb-client-go/v2/api"
 )
 
 // InfluxDBApi is a struct containing the InfluxDB client and the
@@ -55,41 +55,64 @@ func (api InfluxDBApi) GetLastMetric(host string) (*system_metrics.Metric, error
 		results[result.Record().Field()] = result.Record().Value()
 	}
 
-	// Convert the map to JSON so it can be unmarshalled into a struct
-	j, err := json.Marshal(results)
-	if err != nil {
-		return nil, err
+	if len(results) == 0 {
+		return nil, fmt.Errorf("No metrics found for host '%s' in bucket '%s'", host, api.Bucket)
 	}
 
-	// Unmarshal the JSON into a struct
-	metric := system_metrics.Metric{}
-	if err := json.Unmarshal(j, &metric); err != nil {
-		return nil, err
-	}
+	// The fields of the metric are the fields that were found in the database
+	metric := system_metrics.MetricsFromMaps([]map[string]interface{}{results})[0]
 
-	return &metric, nil
+	return metric, nil
 }
 
-// WriteMetrics writes the given system metrics to InfluxDB asynchronously.
+// WriteMetrics writes the given system metrics to InfluxDB in batches.
 // It takes the metrics to be written, the time gap between the newest metric and the end time,
 // and a callback function to be executed after each metric is written.
 // Returns an error if any error occurs during the writing process.
 // This function will mutate the timestamps of the metrics to match the time they were written.
 func (api InfluxDBApi) WriteMetrics(metrics system_metrics.SystemMetric, gap time.Duration, onWrite func()) error {
-	// Create a non-blocking write client
-	writeAPI := api.WriteAPI(api.Org, api.Bucket)
+	return api.WriteMetricsFrom(metrics, StartTime(metrics, gap), onWrite)
+}
 
+// StartTime calculates the absolute time that the relative timestamps of the metrics are translated from.
+// The time is chosen so that the last metric is written gap time before now.
+// The absolute time of a metric is the start time plus the relative timestamp of the metric (in seconds).
+func StartTime(metrics system_metrics.SystemMetric, gap time.Duration) time.Time {
 	// To get the correct timestamp, we need to calculate the time of the first metric to be written.
 	// This needs to take the time gap into account to leave a gap between the last metric and now.
 	// To do this, we take the current time and subtract gap from it leaving us with the time of the last metric to be written.
 	// We then subtract the timestamp of the last metric in the slice from the time of the last metric to be written.
 	// This leaves us with the time of the first metric to be written.
+	return StartTimeUntil(metrics.Metrics[len(metrics.Metrics)-1].Timestamp, gap)
+}
+
+// StartTimeUntil works like StartTime but takes the relative timestamp of the last metric instead of the metrics.
+// This is useful when the metrics are read one at a time and never held in memory together.
+func StartTimeUntil(last int64, gap time.Duration) time.Time {
 	now := time.Now()
 	end := now.Add(-gap)
-	then := end.Add(time.Second * time.Duration(-metrics.Metrics[len(metrics.Metrics)-1].Timestamp))
+	return end.Add(time.Second * time.Duration(-last))
+}
+
+// WriteMetricsFrom writes the given system metrics to InfluxDB in batches.
+// It works like WriteMetrics but takes the start time (see StartTime) instead of the gap.
+// This is useful when the start time has to be known before the metrics are written.
+// This function will mutate the timestamps of the metrics to match the time they were written.
+func (api InfluxDBApi) WriteMetricsFrom(metrics system_metrics.SystemMetric, then time.Time, onWrite func()) error {
+	return api.WriteMetricIterator(metrics.Id, metrics.Iterator(), then, onWrite)
+}
+
+// WriteMetricIterator writes the metrics of the iterator to InfluxDB in batches as the metrics of the given host.
+// It works like WriteMetricsFrom but reads the metrics one at a time, so a whole file never has to be in memory.
+// Returns the error of the iterator if it fails while reading the metrics, or the error of the first batch that could
+// not be written. Nothing more is written after an error, so the metrics may only be partly written.
+// This function will mutate the timestamps of the metrics to match the time they were written.
+func (api InfluxDBApi) WriteMetricIterator(id string, metrics system_metrics.MetricIterator, then time.Time, onWrite func()) error {
+	writeAPI := api.batchWriteAPI()
 
 	// Iterate over the metrics and write them to InfluxDB
-	for _, x := range metrics.Metrics {
+	for metrics.Next() {
+		x := metrics.Metric()
 		// Calculate the timestamp of the metricTime metric
 		metricTime := then.Add(time.Second * time.Duration(x.Timestamp))
 		// Convert the timestamp to unix time
@@ -97,17 +120,20 @@ func (api InfluxDBApi) WriteMetrics(metrics system_metrics.SystemMetric, gap tim
 
 		// Create a new point and write it to InfluxDB
 		// The host is stored as a tag instead of a field to make it easier to filter the data
-		p := influxdb2.NewPoint(api.Measurement, map[string]string{"host": metrics.Id}, x.ToMap(), metricTime)
-		writeAPI.WritePoint(p)
+		p := influxdb2.NewPoint(api.Measurement, map[string]string{"host": id}, x.ToMap(), metricTime)
+		if err := writeAPI.WritePoint(context.Background(), p); err != nil {
+			return err
+		}
 
 		// Execute the callback function (usually used to update the progress bar)
 		onWrite()
 	}
+	if err := metrics.Err(); err != nil {
+		return err
+	}
 
 	// Write any remaining points
-	writeAPI.Flush()
-	// FIXME: Handle errors that might occur when writing asynchronously
-	return nil
+	return writeAPI.Flush(context.Background())
 }
 
 // GetMetrics gets the metrics for the given host from InfluxDB within the given time.
@@ -148,6 +174,7 @@ func (api InfluxDBApi) GetMetrics(host, duration string) (system_metrics.SystemM
 		delete(currentValue, "_start")
 		delete(currentValue, "_stop")
 		delete(currentValue, "_time")
+		delete(currentValue, "table")
 		metrics = append(metrics, currentValue)
 	}
 
@@ -157,20 +184,8 @@ func (api InfluxDBApi) GetMetrics(host, duration string) (system_metrics.SystemM
 		return system_metrics.SystemMetric{}, result.Err()
 	}
 
-	// Convert the slice to JSON so it can be unmarshalled into a struct
-	parsed, err := json.Marshal(metrics)
-	if err != nil {
-		log.Printf("Error when encoding data to json: %v\n", err)
-		return system_metrics.SystemMetric{}, err
-	}
-
-	// Unmarshal the JSON into a struct
-	var parsedMetrics []*system_metrics.Metric
-	err = json.Unmarshal(parsed, &parsedMetrics)
-	if err != nil {
-		log.Printf("Error when decoding json to struct: %v\n", err)
-		return system_metrics.SystemMetric{}, err
-	}
+	// Convert the rows to metrics, the fields of the metrics are the fields that were found in the database
+	parsedMetrics := system_metrics.MetricsFromMaps(metrics)
 
 	// Check if any metrics were found
 	// If the database doesn't contain any metrics for the given duration, the query will return an empty result without throwing an error
@@ -285,6 +300,40 @@ func (api InfluxDBApi) WriteAnomalies(anomalies []system_metrics.AnomalyDetectio
 	return nil
 }
 
+// WriteGroundTruth writes the labels of an injected anomaly to InfluxDB in batches.
+// It takes the labels to be written, the host the anomaly was injected into, the name of the anomaly and the anomaly
+// spec (the name and parameters) it was injected with. The spec is used to tell apart anomalies with the same name.
+// The seed the random draws of the anomaly were made with is stored as well so the injection can be replayed.
+// Only the host and the name of the anomaly are tags, the spec and the seed are fields since they differ between runs
+// and every new tag value creates a new series.
+// The labels have the same shape as the output of the anomaly detection so they can be compared to each other.
+// The timestamps of the labels must already be absolute.
+// Returns an error if any error occurs during the writing process.
+func (api InfluxDBApi) WriteGroundTruth(labels []system_metrics.AnomalyDetectionOutput, host string, anomaly string, spec string, seed int64) error {
+	writeAPI := api.batchWriteAPI()
+
+	// Iterate over the labels and write them to InfluxDB
+	for _, l := range labels {
+		fields := l.ToMap()
+		fields["spec"] = spec
+		fields["seed"] = seed
+		// Create a new point and write it to InfluxDB
+		p := influxdb2.NewPoint(api.Measurement, map[string]string{"host": host, "anomaly": anomaly}, fields, time.Unix(l.Timestamp, 0))
+		if err := writeAPI.WritePoint(context.Background(), p); err != nil {
+			return err
+		}
+	}
+	// Write any remaining points
+	return writeAPI.Flush(context.Background())
+}
+
+// batchWriteAPI returns a write client that collects the points in batches like the non-blocking client of WriteAPI
+// but returns the error of every batch it writes. The non-blocking client is shared by everything writing to the
+// bucket, so the errors of its writes can not be told apart. Every call returns a new client, it must be flushed.
+func (api InfluxDBApi) batchWriteAPI() influxapi.WriteAPIBlocking {
+	return influxapi.NewWriteAPIBlockingWithBatching(api.Org, api.Bucket, api.HTTPService(), api.Options().WriteOptions())
+}
+
 // ParseDurationString parses a string like 1d, 1h or 1m and returns a time.Duration
 // Supports days, hours and minutes (d, h, m)
 // Does not return an error if the string is empty, instead it returns 0. This is to allow for default values.
@@ -0,0 +1,126 @@
+package system_metrics
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Metric files can be stored compressed so large datasets do not need decompressed copies on disk.
+// The compression is given by the extension after .csv or .jsonl and the files are decompressed while they are read
+// and compressed while they are written.
+
+// MetricFileExtensions are the extensions of the metric files that can be read, see MetricFileExtension
+var MetricFileExtensions = []string{".csv", ".csv.gz", ".csv.zst", ".parquet", ".jsonl", ".jsonl.gz", ".jsonl.zst"}
+
+// decompressors wrap a reader of a compressed file in a reader of the decompressed content, by file extension
+var decompressors = map[string]func(r io.Reader) (io.ReadCloser, error){
+	".csv.gz":    gunzip,
+	".csv.zst":   unzstd,
+	".jsonl.gz":  gunzip,
+	".jsonl.zst": unzstd,
+}
+
+// compressors wrap a writer in a writer that compresses what is written to it, by file extension
+var compressors = map[string]func(w io.Writer) (io.WriteCloser, error){
+	".csv.gz":    gzipWriter,
+	".csv.zst":   zstdWriter,
+	".jsonl.gz":  gzipWriter,
+	".jsonl.zst": zstdWriter,
+}
+
+// gzipWriter compresses a gzip file while it is written
+func gzipWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+// zstdWriter compresses a zstd file while it is written
+func zstdWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+}
+
+// nopWriteCloser is a writer whose Close does nothing, used for files that are not compressed
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// NewCompressedWriter returns a writer that compresses what is written to w if the extension of filePath is that of a
+// compressed file, e.g. .jsonl.gz, and writes it as it is otherwise.
+// The writer must be closed to write the end of the compressed data, closing it does not close w. Compressed data
+// appended to a file that already holds compressed data of the same kind is read as one file.
+// Returns an error if the compressor can not be created.
+func NewCompressedWriter(w io.Writer, filePath string) (io.WriteCloser, error) {
+	compress, compressed := compressors[strings.ToLower(MetricFileExtension(filePath))]
+	if !compressed {
+		return nopWriteCloser{w}, nil
+	}
+	return compress(w)
+}
+
+// gunzip decompresses a gzip file while it is read
+func gunzip(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// unzstd decompresses a zstd file while it is read
+func unzstd(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+// MetricFileExtension returns the extension of a metric file that can be read, e.g. .csv, .csv.gz or .parquet.
+// The extension is matched case-insensitively but returned as it is in the file name.
+// Returns an empty string if the file does not have any of the MetricFileExtensions.
+func MetricFileExtension(filePath string) string {
+	lower := strings.ToLower(filePath)
+	for _, extension := range MetricFileExtensions {
+		if strings.HasSuffix(lower, extension) {
+			return filePath[len(filePath)-len(extension):]
+		}
+	}
+	return ""
+}
+
+// decompressedFile is the decompressed content of a file, closing it closes both the decompressor and the file
+type decompressedFile struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (f decompressedFile) Close() error {
+	err := f.ReadCloser.Close()
+	if fileErr := f.file.Close(); err == nil {
+		err = fileErr
+	}
+	return err
+}
+
+// openDecompressed opens a file and decompresses it while it is read if its extension is that of a compressed file.
+// Returns an error if the file can not be opened or does not start like a file of its compression.
+func openDecompressed(filePath string) (io.ReadCloser, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	decompress, compressed := decompressors[strings.ToLower(MetricFileExtension(filePath))]
+	if !compressed {
+		return file, nil
+	}
+	reader, err := decompress(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: could not decompress file: %v", filePath, err)
+	}
+	return decompressedFile{ReadCloser: reader, file: file}, nil
+}
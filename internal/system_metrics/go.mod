@@ -2,4 +2,12 @@ module pdc-mad/system_metrics
 
 go 1.20
 
-require github.com/gocarina/gocsv v0.0.0-20231116093920-b87c2d0e983a
+require (
+	github.com/fraugster/parquet-go v0.12.0
+	github.com/klauspost/compress v1.17.9
+)
+
+require (
+	github.com/apache/thrift v0.16.0 // indirect
+	github.com/golang/snappy v0.0.4 // indirect
+)
@@ -0,0 +1,362 @@
+package system_metrics
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Metrics and anomalies can also be stored as newline-delimited JSON (JSONL), one object per line, so log pipelines
+// can ingest them directly. A metric is an object with a timestamp key and a key for every field like the columns of
+// the CSV files, e.g. {"timestamp":1,"cpu-user-0":0.5,"mem-used":1024}. Integer fields are written without a decimal
+// point. When read, the values can be numbers, booleans or numbers in strings, and null or missing values are 0.
+// Blank lines are skipped.
+
+// IsJSONL returns whether the file is a JSONL file by its extension, compressed or not, e.g. .jsonl or .jsonl.gz
+func IsJSONL(filePath string) bool {
+	return strings.HasPrefix(strings.ToLower(MetricFileExtension(filePath)), ".jsonl")
+}
+
+// schemaFromObject returns the schema of a JSON object of a metric, every key except the timestamp is a field.
+// Fields of the dataset provided by Westermo keep their type, fields with boolean values are integer fields and all
+// other fields are floats. The fields of the dataset provided by Westermo come first, the others are sorted by name.
+func schemaFromObject(object map[string]json.RawMessage) *Schema {
+	names, ints := []string{}, map[string]bool{}
+	for name, raw := range object {
+		if name == "timestamp" {
+			continue
+		}
+		names = append(names, name)
+		text := string(bytes.TrimSpace(raw))
+		ints[name] = text == "true" || text == "false"
+	}
+	return schemaFromNames(names, ints)
+}
+
+// metricFromObject converts a JSON object to a metric with the given schema, fields missing from the object are 0.
+// Returns an error if the object has no timestamp or a value is not a number.
+func metricFromObject(object map[string]json.RawMessage, schema *Schema) (*Metric, error) {
+	raw, exists := object["timestamp"]
+	if !exists {
+		return nil, fmt.Errorf("the object has no timestamp")
+	}
+	text, err := jsonText(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp %s", raw)
+	}
+	metric := NewMetric(schema, 0)
+	if metric.Timestamp, err = parseInt(text); err != nil {
+		return nil, fmt.Errorf("invalid timestamp %s", raw)
+	}
+	for _, name := range schema.Names() {
+		raw, exists := object[name]
+		if !exists {
+			continue
+		}
+		text, err := jsonText(raw)
+		if err == nil {
+			if schema.IsInt(name) {
+				var value int64
+				value, err = parseInt(text)
+				metric.Values[name] = float64(value)
+			} else {
+				metric.Values[name], err = parseFloat(text)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %s for %s", raw, name)
+		}
+	}
+	return metric, nil
+}
+
+// jsonText returns the text of a JSON number, boolean or string value so it can be parsed like a CSV cell.
+// Booleans are 1 or 0 and null is empty.
+// Returns an error if the value is an object or an array.
+func jsonText(raw json.RawMessage) (string, error) {
+	text := string(bytes.TrimSpace(raw))
+	switch {
+	case text == "null":
+		return "", nil
+	case text == "true":
+		return "1", nil
+	case text == "false":
+		return "0", nil
+	case strings.HasPrefix(text, `"`):
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return strings.TrimSpace(s), err
+	case strings.HasPrefix(text, "{") || strings.HasPrefix(text, "["):
+		return "", fmt.Errorf("%s is not a number", text)
+	}
+	return text, nil
+}
+
+// JSONLReader reads metrics from JSONL line by line, it implements MetricFile.
+// The keys of the objects are matched to the fields of the schema by name, like the columns of a MetricReader.
+type JSONLReader struct {
+	reader *bufio.Reader
+	closer io.Closer // The (decompressed) file the metrics are read from, nil if the reader was not opened by OpenJSONLFile
+	schema *Schema
+	line   int             // The number of the current line, starting at 1
+	first  json.RawMessage // The first object, read to find the schema and not yet returned by Next
+	metric *Metric
+	err    error
+}
+
+// NewJSONLReader returns a JSONLReader reading from r. The first object is read right away.
+// If schema is nil, the schema is taken from the keys of the first object, see UnmarshalJSON. Otherwise the metrics
+// have the fields of the schema and other keys are ignored.
+// Returns an error if the first object can not be read or, when a schema is given, lacks a field of the schema.
+// Later objects can leave out fields, they are 0.
+func NewJSONLReader(r io.Reader, schema *Schema) (*JSONLReader, error) {
+	metrics := JSONLReader{reader: bufio.NewReader(r)}
+	first, err := metrics.readLine()
+	if err == io.EOF {
+		return nil, fmt.Errorf("the JSONL has no metrics")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	object := map[string]json.RawMessage{}
+	if err := json.Unmarshal(first, &object); err != nil {
+		return nil, fmt.Errorf("line %d: %v", metrics.line, err)
+	}
+	if schema == nil {
+		schema = schemaFromObject(object)
+	}
+	for _, name := range schema.Names() {
+		if _, exists := object[name]; !exists {
+			return nil, fmt.Errorf("line %d: the object has no value for field %s of the schema", metrics.line, name)
+		}
+	}
+	metrics.schema = schema
+	metrics.first = first
+	return &metrics, nil
+}
+
+// readLine returns the next line that is not blank.
+// Returns io.EOF at the end of the input.
+func (r *JSONLReader) readLine() ([]byte, error) {
+	for {
+		line, err := r.reader.ReadBytes('\n')
+		if len(line) > 0 {
+			r.line++
+		}
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			// The last line does not need to end with a newline
+			return trimmed, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// OpenJSONLFile opens a JSONL file of metrics and returns a JSONLReader reading from it, see NewJSONLReader.
+// Files ending in .jsonl.gz or .jsonl.zst are decompressed while they are read.
+// The reader must be closed when it is no longer needed.
+// Returns an error if the file can not be opened or its first object is not valid.
+func OpenJSONLFile(filePath string, schema *Schema) (*JSONLReader, error) {
+	file, err := openDecompressed(filePath)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := NewJSONLReader(file, schema)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+	reader.closer = file
+	return reader, nil
+}
+
+// Schema returns the schema of the metrics read by the reader
+func (r *JSONLReader) Schema() *Schema {
+	return r.schema
+}
+
+// Next reads the next object of the JSONL
+func (r *JSONLReader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	line := r.first
+	r.first = nil
+	if line == nil {
+		var err error
+		if line, err = r.readLine(); err == io.EOF {
+			return false
+		} else if err != nil {
+			r.err = err
+			return false
+		}
+	}
+
+	object := map[string]json.RawMessage{}
+	if err := json.Unmarshal(line, &object); err != nil {
+		r.err = fmt.Errorf("line %d: %v", r.line, err)
+		return false
+	}
+	metric, err := metricFromObject(object, r.schema)
+	if err != nil {
+		r.err = fmt.Errorf("line %d: %v", r.line, err)
+		return false
+	}
+	r.metric = metric
+	return true
+}
+
+// Metric returns the metric of the last object read by Next
+func (r *JSONLReader) Metric() *Metric {
+	return r.metric
+}
+
+// Err returns the error that stopped the reader, nil at the end of the input
+func (r *JSONLReader) Err() error {
+	return r.err
+}
+
+// Close closes the file of a reader opened by OpenJSONLFile, it does nothing for other readers
+func (r *JSONLReader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+// WriteJSONL writes the metrics as JSONL to the writer, one object per metric, see MarshalJSON.
+// The fields are written in the order of the schema of the metrics.
+// Returns an error if something fails.
+func (sm SystemMetric) WriteJSONL(w io.Writer) error {
+	writer := bufio.NewWriter(w)
+	for _, m := range sm.Metrics {
+		line, err := m.MarshalJSON()
+		if err != nil {
+			return fmt.Errorf("metric at %d: %v", m.Timestamp, err)
+		}
+		writer.Write(line)
+		writer.WriteByte('\n')
+	}
+	return writer.Flush()
+}
+
+// MarshalJSON encodes the output as a JSON object with the timestamp and whether every field is anomalous, e.g.
+// {"timestamp":1,"cpu-user-0":false,"mem-used":true}. The fields are sorted by name.
+func (am AnomalyDetectionOutput) MarshalJSON() ([]byte, error) {
+	names := make([]string, 0, len(am.Fields))
+	for name := range am.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buffer bytes.Buffer
+	buffer.WriteString(`{"timestamp":`)
+	buffer.WriteString(strconv.FormatInt(am.Timestamp, 10))
+	for _, name := range names {
+		key, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		buffer.WriteByte(',')
+		buffer.Write(key)
+		buffer.WriteByte(':')
+		buffer.WriteString(strconv.FormatBool(am.Fields[name]))
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalJSON decodes a JSON object of an AnomalyDetectionOutput, every key except the timestamp is a field.
+// The fields can be anything ParseAnomalyDetectionOutputCSV accepts, as JSON booleans, numbers or strings.
+// Returns an error if the object has no timestamp or a value can not be parsed.
+func (am *AnomalyDetectionOutput) UnmarshalJSON(data []byte) error {
+	object := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+	output := AnomalyDetectionOutput{Fields: make(map[string]bool, len(object))}
+	for name, raw := range object {
+		text, err := jsonText(raw)
+		if err == nil {
+			if name == "timestamp" {
+				output.Timestamp, err = parseInt(text)
+			} else {
+				output.Fields[name], err = parseBool(text)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value %s for %s", raw, name)
+		}
+	}
+	if _, exists := object["timestamp"]; !exists {
+		return fmt.Errorf("the object has no timestamp")
+	}
+	*am = output
+	return nil
+}
+
+// WriteJSONL writes the values as JSONL to the writer, one object per line.
+// Used for AnomalyDetectionOutput and AnomalyEvent structs, see their JSON encoding.
+// Returns an error if something fails.
+func WriteJSONL[T any](w io.Writer, values []T) error {
+	writer := bufio.NewWriter(w)
+	// The encoder ends every value with a newline
+	encoder := json.NewEncoder(writer)
+	encoder.SetEscapeHTML(false)
+	for i := range values {
+		if err := encoder.Encode(values[i]); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// ReadJSONL reads JSONL from the reader, one value per line, blank lines are skipped.
+// Used for AnomalyDetectionOutput and AnomalyEvent structs, see their JSON encoding.
+// Returns an error with the line number if a line can not be decoded.
+func ReadJSONL[T any](r io.Reader) ([]T, error) {
+	reader := JSONLReader{reader: bufio.NewReader(r)}
+	values := []T{}
+	for {
+		line, err := reader.readLine()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var value T
+		if err := json.Unmarshal(line, &value); err != nil {
+			return nil, fmt.Errorf("line %d: %v", reader.line, err)
+		}
+		values = append(values, value)
+	}
+}
+
+// ParseAnomalyDetectionOutputJSONL parses a JSONL file of AnomalyDetectionOutput structs like
+// ParseAnomalyDetectionOutputCSV parses a CSV file, see AnomalyDetectionOutput.UnmarshalJSON.
+// Returns an error if something fails.
+func ParseAnomalyDetectionOutputJSONL(filename, host string) (*[]AnomalyDetectionOutput, error) {
+	inputFile, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer inputFile.Close()
+
+	anomalyData, err := ReadJSONL[AnomalyDetectionOutput](inputFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if len(anomalyData) == 0 {
+		return nil, fmt.Errorf("output of anomaly detection is empty")
+	}
+	return &anomalyData, nil
+}
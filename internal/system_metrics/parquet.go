@@ -0,0 +1,291 @@
+package system_metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	goparquet "github.com/fraugster/parquet-go"
+	"github.com/fraugster/parquet-go/parquet"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Metrics can also be stored in Apache Parquet files. A Parquet file of metrics has a timestamp column and a column for
+// every field like the CSV files, the columns must be flat and not repeated. Written files use 64 bit integer columns
+// for the timestamp and the integer fields and double columns for the other fields, compressed with Snappy. When read,
+// the timestamp can be any integer column, including a Parquet timestamp which is converted to seconds, and the fields
+// can be any integer, floating point or boolean column. Null values are read as 0 like empty CSV cells.
+// Files compressed with Snappy, gzip or zstd can be read.
+
+func init() {
+	// The Parquet library only handles Snappy and gzip by itself, zstd is common in files written by other tools
+	goparquet.RegisterBlockCompressor(parquet.CompressionCodec_ZSTD, zstdBlockCompressor{})
+}
+
+// zstdBlockCompressor compresses and decompresses the pages of Parquet files with zstd
+type zstdBlockCompressor struct{}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+)
+
+func (zstdBlockCompressor) CompressBlock(block []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(block, nil), nil
+}
+
+func (zstdBlockCompressor) DecompressBlock(block []byte) ([]byte, error) {
+	return zstdDecoder.DecodeAll(block, nil)
+}
+
+// ParquetReader reads metrics from a Parquet file row by row, it implements MetricFile.
+// The columns are matched to the fields of the schema by name, like the columns of a MetricReader.
+type ParquetReader struct {
+	file      *os.File // The file the metrics are read from, nil if the reader was not opened by OpenParquetFile
+	reader    *goparquet.FileReader
+	schema    *Schema
+	perSecond int64 // How many units of the timestamp column there are per second
+	row       int   // The number of the current row, starting at 1
+	metric    *Metric
+	err       error
+}
+
+// NewParquetReader returns a ParquetReader reading the Parquet file in r. The metadata of the file is read right away.
+// If schema is nil, the schema is taken from the columns of the file and every column except the timestamp is a field.
+// Integer and boolean columns are integer fields. The fields of the dataset provided by Westermo come first in their
+// usual order, the others are sorted by name. Otherwise the metrics have the fields of the schema and only the columns of
+// the schema are read.
+// Returns an error if the file is not a valid Parquet file, has no timestamp column, has columns that can not be read
+// or lacks a field of the schema.
+func NewParquetReader(r io.ReadSeeker, schema *Schema) (*ParquetReader, error) {
+	reader, err := goparquet.NewFileReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the Parquet file: %v", err)
+	}
+
+	metrics := ParquetReader{reader: reader}
+	names, ints := []string{}, map[string]bool{}
+	for _, column := range reader.Columns() {
+		if len(column.Path()) > 1 || column.MaxRepetitionLevel() > 0 {
+			if schema == nil {
+				return nil, fmt.Errorf("column %s is nested or repeated, only flat columns can be read", column.FlatName())
+			}
+			continue
+		}
+		name := column.Name()
+		if schema != nil && name != "timestamp" && !schema.Has(name) {
+			continue
+		}
+
+		columnType := column.Type()
+		if name == "timestamp" {
+			if columnType == nil || (*columnType != parquet.Type_INT32 && *columnType != parquet.Type_INT64) {
+				return nil, fmt.Errorf("the timestamp column must be an integer, not %v", columnType)
+			}
+			metrics.perSecond = timestampUnitsPerSecond(column.Element())
+			continue
+		}
+		switch {
+		case columnType == nil:
+			return nil, fmt.Errorf("column %s has no type", name)
+		case *columnType == parquet.Type_BOOLEAN || *columnType == parquet.Type_INT32 || *columnType == parquet.Type_INT64:
+			ints[name] = true
+		case *columnType == parquet.Type_FLOAT || *columnType == parquet.Type_DOUBLE:
+		default:
+			// Columns of other types, e.g. strings, can be skipped by giving a schema without them
+			return nil, fmt.Errorf("column %s has the type %v, it must be a number or a boolean", name, columnType)
+		}
+		names = append(names, name)
+	}
+	if metrics.perSecond == 0 {
+		return nil, fmt.Errorf("the Parquet file has no timestamp column")
+	}
+
+	if schema == nil {
+		schema = schemaFromNames(names, ints)
+	}
+	found := map[string]bool{}
+	for _, name := range names {
+		found[name] = true
+	}
+	for _, name := range schema.Names() {
+		if !found[name] {
+			return nil, fmt.Errorf("the Parquet file has no column for field %s of the schema", name)
+		}
+	}
+	selected := []goparquet.ColumnPath{{"timestamp"}}
+	for _, name := range schema.Names() {
+		selected = append(selected, goparquet.ColumnPath{name})
+	}
+	reader.SetSelectedColumnsByPath(selected...)
+	metrics.schema = schema
+	return &metrics, nil
+}
+
+// timestampUnitsPerSecond returns how many units of the timestamp column with the given schema element there are per
+// second. Plain integers are seconds like the timestamps of the CSV files.
+func timestampUnitsPerSecond(element *parquet.SchemaElement) int64 {
+	if logicalType := element.GetLogicalType(); logicalType != nil && logicalType.IsSetTIMESTAMP() {
+		switch unit := logicalType.TIMESTAMP.Unit; {
+		case unit.IsSetMILLIS():
+			return 1e3
+		case unit.IsSetMICROS():
+			return 1e6
+		case unit.IsSetNANOS():
+			return 1e9
+		}
+	}
+	if element.IsSetConvertedType() {
+		switch element.GetConvertedType() {
+		case parquet.ConvertedType_TIMESTAMP_MILLIS:
+			return 1e3
+		case parquet.ConvertedType_TIMESTAMP_MICROS:
+			return 1e6
+		}
+	}
+	return 1
+}
+
+// OpenParquetFile opens a Parquet file of metrics and returns a ParquetReader reading from it, see NewParquetReader.
+// The reader must be closed when it is no longer needed.
+// Returns an error if the file can not be opened or is not a valid Parquet file of metrics.
+func OpenParquetFile(filePath string, schema *Schema) (*ParquetReader, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := NewParquetReader(file, schema)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+	reader.file = file
+	return reader, nil
+}
+
+// Schema returns the schema of the metrics read by the reader
+func (r *ParquetReader) Schema() *Schema {
+	return r.schema
+}
+
+// Next reads the next row of the Parquet file
+func (r *ParquetReader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	row, err := r.reader.NextRow()
+	if err == io.EOF {
+		return false
+	}
+	if err != nil {
+		r.err = err
+		return false
+	}
+	r.row++
+
+	metric := NewMetric(r.schema, 0)
+	// The timestamp is converted without going through a float, nanoseconds do not fit in one
+	switch timestamp := row["timestamp"].(type) {
+	case int32:
+		metric.Timestamp = int64(timestamp) / r.perSecond
+	case int64:
+		metric.Timestamp = timestamp / r.perSecond
+	}
+	for _, name := range r.schema.Names() {
+		value, ok := parquetFloat(row[name])
+		if !ok {
+			r.err = fmt.Errorf("row %d: invalid value %v in column %s", r.row, row[name], name)
+			return false
+		}
+		if r.schema.IsInt(name) {
+			value = math.Trunc(value)
+		}
+		metric.Values[name] = value
+	}
+	r.metric = metric
+	return true
+}
+
+// parquetFloat returns a value of a number or boolean column as a float, null (a missing value) is 0.
+// Returns false if the value is not a number or a boolean.
+func parquetFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case nil:
+		return 0, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// Metric returns the metric of the last row read by Next
+func (r *ParquetReader) Metric() *Metric {
+	return r.metric
+}
+
+// Err returns the error that stopped the reader, nil at the end of the file
+func (r *ParquetReader) Err() error {
+	return r.err
+}
+
+// Close closes the file of a reader opened by OpenParquetFile, it does nothing for other readers
+func (r *ParquetReader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
+
+// WriteParquet writes the metrics as a Parquet file to the writer, see the format above.
+// The columns are written in the order of the fields of the schema of the metrics, after the timestamp.
+// Returns an error if something fails.
+func (sm SystemMetric) WriteParquet(w io.Writer) error {
+	writer := goparquet.NewFileWriter(w, goparquet.WithCompressionCodec(parquet.CompressionCodec_SNAPPY), goparquet.WithCreator("pdc-mad"))
+
+	fields := append([]Field{{Name: "timestamp", Int: true}}, sm.Schema().Fields()...)
+	for _, field := range fields {
+		var store *goparquet.ColumnStore
+		var err error
+		if field.Int {
+			store, err = goparquet.NewInt64Store(parquet.Encoding_PLAIN, true, &goparquet.ColumnParameters{})
+		} else {
+			store, err = goparquet.NewDoubleStore(parquet.Encoding_PLAIN, true, &goparquet.ColumnParameters{})
+		}
+		if err != nil {
+			return err
+		}
+		// The path is given as is so field names with dots are not taken as nested columns
+		if err := writer.AddColumnByPath(goparquet.ColumnPath{field.Name}, goparquet.NewDataColumn(store, parquet.FieldRepetitionType_REQUIRED)); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range sm.Metrics {
+		row := make(map[string]interface{}, len(fields))
+		row["timestamp"] = m.Timestamp
+		for _, field := range fields[1:] {
+			// Fields a metric does not have are written as 0 since the columns are required
+			if field.Int {
+				row[field.Name] = int64(m.Values[field.Name])
+			} else {
+				row[field.Name] = m.Values[field.Name]
+			}
+		}
+		if err := writer.AddData(row); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
@@ -0,0 +1,322 @@
+package system_metrics
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetricIterator yields metrics one at a time so a series can be processed without holding all of it in memory.
+// It is used like bufio.Scanner:
+//
+//	for it.Next() {
+//		m := it.Metric()
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type MetricIterator interface {
+	// Next advances to the next metric. Returns false at the end of the metrics or if an error occurred.
+	Next() bool
+	// Metric returns the current metric. It stays valid after the next call to Next, so it can be kept.
+	Metric() *Metric
+	// Err returns the error that stopped the iteration, nil if the end of the metrics was reached.
+	Err() error
+}
+
+// MetricFile is an open file of metrics, either a MetricReader, a ParquetReader or a JSONLReader.
+type MetricFile interface {
+	MetricIterator
+	// Schema returns the schema of the metrics read from the file
+	Schema() *Schema
+	// Close closes the file
+	Close() error
+}
+
+// isParquet returns whether the metric file is a Parquet file
+func isParquet(filePath string) bool {
+	return strings.EqualFold(MetricFileExtension(filePath), ".parquet")
+}
+
+// MetricReader reads metrics from CSV row by row, it implements MetricIterator.
+// The CSV must have a timestamp column like the dataset provided by Westermo, the other columns are the fields of the
+// metrics. The columns are matched to the fields of the schema by the header, so their order does not matter.
+type MetricReader struct {
+	csv       *csv.Reader
+	closer    io.Closer // The (decompressed) file the metrics are read from, nil if the reader was not opened by OpenMetricFile
+	schema    *Schema
+	timestamp int      // The index of the timestamp column
+	columns   []string // The field of every column, empty for the timestamp and the columns that are not in the schema
+	metric    *Metric
+	err       error
+}
+
+// NewMetricReader returns a MetricReader reading from r. The header is read right away.
+// If schema is nil, the schema is taken from the header and every column except the timestamp is a field, see
+// SchemaFromHeader. Otherwise the metrics have the fields of the schema, columns that are not in the schema are ignored.
+// Returns an error if the header can not be read, has no timestamp column or lacks a field of the schema.
+func NewMetricReader(r io.Reader, schema *Schema) (*MetricReader, error) {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read the CSV header: %v", err)
+	}
+	for i, name := range header {
+		header[i] = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+	}
+	if schema == nil {
+		if schema, err = SchemaFromHeader(header); err != nil {
+			return nil, err
+		}
+	}
+
+	metrics := MetricReader{csv: reader, schema: schema, timestamp: -1, columns: make([]string, len(header))}
+	found := map[string]bool{}
+	for i, name := range header {
+		if name == "timestamp" {
+			metrics.timestamp = i
+		} else if schema.Has(name) {
+			metrics.columns[i] = name
+			found[name] = true
+		}
+	}
+	if metrics.timestamp == -1 {
+		return nil, fmt.Errorf("the CSV has no timestamp column")
+	}
+	for _, name := range schema.Names() {
+		if !found[name] {
+			return nil, fmt.Errorf("the CSV has no column for field %s of the schema", name)
+		}
+	}
+	return &metrics, nil
+}
+
+// OpenMetricFile opens a file of metrics and returns a MetricFile reading from it.
+// Files ending in .parquet are read by a ParquetReader, see OpenParquetFile, and files ending in .jsonl (compressed
+// or not) by a JSONLReader, see OpenJSONLFile. Other files are read as CSV by a
+// MetricReader, see NewMetricReader, and files ending in .csv.gz or .csv.zst are decompressed while they are read.
+// The reader must be closed when it is no longer needed.
+// Returns an error if the file can not be opened or its header is not valid.
+func OpenMetricFile(filePath string, schema *Schema) (MetricFile, error) {
+	if isParquet(filePath) {
+		return OpenParquetFile(filePath, schema)
+	}
+	if IsJSONL(filePath) {
+		return OpenJSONLFile(filePath, schema)
+	}
+	file, err := openDecompressed(filePath)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := NewMetricReader(file, schema)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+	reader.closer = file
+	return reader, nil
+}
+
+// Schema returns the schema of the metrics read by the reader
+func (r *MetricReader) Schema() *Schema {
+	return r.schema
+}
+
+// Next reads the next row of the CSV
+func (r *MetricReader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	record, err := r.csv.Read()
+	if err == io.EOF {
+		return false
+	}
+	if err != nil {
+		r.err = err
+		return false
+	}
+
+	metric := NewMetric(r.schema, 0)
+	for i, cell := range record {
+		name := r.columns[i]
+		if name == "" && i != r.timestamp {
+			continue
+		}
+		cell = strings.TrimSpace(cell)
+		if i == r.timestamp {
+			metric.Timestamp, err = parseInt(cell)
+		} else if r.schema.IsInt(name) {
+			var value int64
+			value, err = parseInt(cell)
+			metric.Values[name] = float64(value)
+		} else {
+			metric.Values[name], err = parseFloat(cell)
+		}
+		if err != nil {
+			line, _ := r.csv.FieldPos(i)
+			r.err = fmt.Errorf("line %d: invalid value '%s' in column %d: %v", line, cell, i+1, err)
+			return false
+		}
+	}
+	r.metric = metric
+	return true
+}
+
+// parseInt parses the text of a CSV cell as an integer, an empty cell is 0.
+// Integers written as floats (e.g. 1024.0) are truncated.
+func parseInt(text string) (int64, error) {
+	if text == "" {
+		return 0, nil
+	}
+	if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return i, nil
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(math.Trunc(f)), nil
+}
+
+// parseFloat parses the text of a CSV cell as a float, an empty cell is 0
+func parseFloat(text string) (float64, error) {
+	if text == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(text, 64)
+}
+
+// Metric returns the metric of the last row read by Next
+func (r *MetricReader) Metric() *Metric {
+	return r.metric
+}
+
+// Err returns the error that stopped the reader, nil at the end of the CSV
+func (r *MetricReader) Err() error {
+	return r.err
+}
+
+// Close closes the file of a reader opened by OpenMetricFile, it does nothing for other readers
+func (r *MetricReader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+// sliceIterator iterates over the metrics of a slice
+type sliceIterator struct {
+	metrics []*Metric
+	index   int
+}
+
+// Iterator returns a MetricIterator over the metrics of sm.
+// Unlike a MetricReader, the iterator yields the metrics of sm themselves, so changing them changes sm.
+func (sm SystemMetric) Iterator() MetricIterator {
+	return &sliceIterator{metrics: sm.Metrics, index: -1}
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.index+1 >= len(it.metrics) {
+		return false
+	}
+	it.index++
+	return true
+}
+
+func (it *sliceIterator) Metric() *Metric {
+	return it.metrics[it.index]
+}
+
+func (it *sliceIterator) Err() error {
+	return nil
+}
+
+// betweenIterator yields the metrics of another iterator between two relative timestamps
+type betweenIterator struct {
+	MetricIterator
+	from, to int64 // to is exclusive, math.MaxInt64 if there is no end
+	done     bool
+}
+
+// Between returns an iterator yielding the metrics of it between startAt and startAt+duration, the lazy version of
+// SliceBetween. If duration is 0, all metrics after startAt are yielded.
+// Like SliceBetween, a duration longer than the metrics is not an error, the iteration simply ends with the metrics.
+// The iteration stops as soon as the end of the window is passed, the rest of it is never read.
+func Between(it MetricIterator, startAt, duration time.Duration) MetricIterator {
+	to := int64(math.MaxInt64)
+	if duration != 0 {
+		to = int64((startAt + duration).Seconds())
+	}
+	return &betweenIterator{MetricIterator: it, from: int64(startAt.Seconds()), to: to}
+}
+
+func (it *betweenIterator) Next() bool {
+	for !it.done && it.MetricIterator.Next() {
+		timestamp := it.MetricIterator.Metric().Timestamp
+		if timestamp >= it.to {
+			break
+		}
+		if timestamp >= it.from {
+			return true
+		}
+	}
+	it.done = true
+	return false
+}
+
+// peekIterator yields the metrics that were peeked before the rest of the metrics of another iterator
+type peekIterator struct {
+	MetricIterator
+	peeked []*Metric
+	index  int
+}
+
+// Peek reads the first n metrics of it, fewer if it has fewer metrics.
+// Returns the metrics and an iterator that yields all metrics of it, including the peeked ones.
+// Returns an error if it failed while reading the metrics.
+func Peek(it MetricIterator, n int) ([]*Metric, MetricIterator, error) {
+	peeked := []*Metric{}
+	for len(peeked) < n && it.Next() {
+		peeked = append(peeked, it.Metric())
+	}
+	if err := it.Err(); err != nil {
+		return nil, nil, err
+	}
+	return peeked, &peekIterator{MetricIterator: it, peeked: peeked, index: -1}, nil
+}
+
+func (it *peekIterator) Next() bool {
+	if it.index+1 < len(it.peeked) {
+		it.index++
+		return true
+	}
+	it.index = len(it.peeked)
+	return it.MetricIterator.Next()
+}
+
+func (it *peekIterator) Metric() *Metric {
+	if it.index < len(it.peeked) {
+		return it.peeked[it.index]
+	}
+	return it.MetricIterator.Metric()
+}
+
+// Collect reads all metrics of it into a SystemMetric with the given id.
+// Returns an error if it failed while reading the metrics.
+func Collect(it MetricIterator, id string) (*SystemMetric, error) {
+	metrics := []*Metric{}
+	for it.Next() {
+		metrics = append(metrics, it.Metric())
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return &SystemMetric{Id: id, Metrics: metrics}, nil
+}
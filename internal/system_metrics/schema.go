@@ -0,0 +1,174 @@
+package system_metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Field is a field of the metrics, a column of the CSV files besides the timestamp.
+// Tags are used to parse the fields of a schema file.
+type Field struct {
+	Name string `json:"name"`          // Name of the field, the same as the column of the CSV files
+	Int  bool   `json:"int,omitempty"` // Whether the values are integers, they are rounded to the nearest integer when set
+}
+
+// Schema is the ordered list of fields a series of metrics has. The fields are written in this order.
+// The schema is usually taken from the header of the CSV file the metrics are read from, see SchemaFromHeader, but it
+// can also be given as a schema file, see ReadSchemaFile.
+// A Schema must not be changed after it is created, it is shared by all metrics of a series.
+type Schema struct {
+	fields []Field
+	index  map[string]int // The index of every field in fields by name
+}
+
+// westermoFields are the fields of the dataset provided by Westermo in the order of its columns.
+// See: https://github.com/westermo/test-system-performance-dataset/ for more information.
+var westermoFields = []Field{
+	{Name: "load-1m"},
+	{Name: "load-5m"},
+	{Name: "load-15m"},
+	{Name: "sys-mem-swap-total", Int: true},
+	{Name: "sys-mem-swap-free", Int: true},
+	{Name: "sys-mem-free", Int: true},
+	{Name: "sys-mem-cache", Int: true},
+	{Name: "sys-mem-buffered", Int: true},
+	{Name: "sys-mem-available", Int: true},
+	{Name: "sys-mem-total", Int: true},
+	{Name: "sys-fork-rate"},
+	{Name: "sys-interrupt-rate"},
+	{Name: "sys-context-switch-rate"},
+	{Name: "sys-thermal"},
+	{Name: "disk-io-time"},
+	{Name: "disk-bytes-read"},
+	{Name: "disk-bytes-written"},
+	{Name: "disk-io-read"},
+	{Name: "disk-io-write"},
+	{Name: "cpu-iowait"},
+	{Name: "cpu-system"},
+	{Name: "cpu-user"},
+	{Name: "server-up", Int: true},
+}
+
+// WestermoSchema is the schema of the dataset provided by Westermo.
+// The fields of other schemas that have the same name as a field of the dataset get the same type by default.
+var WestermoSchema, _ = NewSchema(westermoFields)
+
+// NewSchema returns a schema with the given fields in order.
+// Returns an error if a field has no name, is called timestamp or appears more than once.
+func NewSchema(fields []Field) (*Schema, error) {
+	schema := Schema{fields: append([]Field{}, fields...), index: map[string]int{}}
+	for i, field := range fields {
+		if field.Name == "" || field.Name == "timestamp" {
+			return nil, fmt.Errorf("invalid field name '%s' in schema", field.Name)
+		}
+		if _, duplicate := schema.index[field.Name]; duplicate {
+			return nil, fmt.Errorf("field %s appears more than once in schema", field.Name)
+		}
+		schema.index[field.Name] = i
+	}
+	return &schema, nil
+}
+
+// SchemaFromHeader returns the schema of a CSV file with the given header, every column except the timestamp is a field.
+// Fields of the dataset provided by Westermo keep their type, all other fields are floats.
+// Returns an error if a column appears more than once.
+func SchemaFromHeader(header []string) (*Schema, error) {
+	fields := []Field{}
+	for _, name := range header {
+		if name == "timestamp" {
+			continue
+		}
+		fields = append(fields, Field{Name: name, Int: WestermoSchema.IsInt(name)})
+	}
+	return NewSchema(fields)
+}
+
+// schemaFromNames returns the schema of fields whose order is not known, e.g. the keys of a map.
+// The fields of the dataset provided by Westermo come first in their usual order, the rest are sorted by name.
+// ints are the fields known to be integers besides those of the dataset provided by Westermo.
+func schemaFromNames(names []string, ints map[string]bool) *Schema {
+	sort.Slice(names, func(i, j int) bool {
+		a, aKnown := WestermoSchema.index[names[i]]
+		b, bKnown := WestermoSchema.index[names[j]]
+		if aKnown != bKnown {
+			return aKnown
+		}
+		if aKnown {
+			return a < b
+		}
+		return names[i] < names[j]
+	})
+	fields := make([]Field, len(names))
+	for i, name := range names {
+		fields[i] = Field{Name: name, Int: ints[name] || WestermoSchema.IsInt(name)}
+	}
+	// The names are the keys of a map so they are unique
+	schema, _ := NewSchema(fields)
+	return schema
+}
+
+// ReadSchemaFile reads a schema from a JSON file on the form
+//
+//	{"fields": [{"name": "cpu-user-0"}, {"name": "mem-used", "int": true}]}
+//
+// Returns an error if the file can not be read or is not a valid schema.
+func ReadSchemaFile(filePath string) (*Schema, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Fields []Field `json:"fields"`
+	}
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+	if len(file.Fields) == 0 {
+		return nil, fmt.Errorf("%s: schema has no fields", filePath)
+	}
+	schema, err := NewSchema(file.Fields)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+	return schema, nil
+}
+
+// Fields returns the fields of the schema in order
+func (s *Schema) Fields() []Field {
+	if s == nil {
+		return nil
+	}
+	return append([]Field{}, s.fields...)
+}
+
+// Names returns the names of the fields of the schema in order
+func (s *Schema) Names() []string {
+	if s == nil {
+		return nil
+	}
+	names := make([]string, len(s.fields))
+	for i, field := range s.fields {
+		names[i] = field.Name
+	}
+	return names
+}
+
+// Has returns whether the schema has a field with the given name
+func (s *Schema) Has(name string) bool {
+	if s == nil {
+		return false
+	}
+	_, exists := s.index[name]
+	return exists
+}
+
+// IsInt returns whether the field with the given name is stored as an integer, false if the field does not exist
+func (s *Schema) IsInt(name string) bool {
+	if s == nil {
+		return false
+	}
+	i, exists := s.index[name]
+	return exists && s.fields[i].Int
+}
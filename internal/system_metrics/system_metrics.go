@@ -1,12 +1,18 @@
 package system_metrics
 
 import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
-
-	"github.com/gocarina/gocsv"
 )
 
 // SystemMetric is a struct that contains the id of a system and a slice of metrics belonging to that system
@@ -19,35 +25,109 @@ type SystemMetric struct {
 }
 
 // Metric is a struct that contains the metrics of a system at a specific time.
-// The fields are the metrics that are collected from the system as specified in the dataset by Westermo.
+// The values are stored by field name, the fields a metric has are given by its schema. Metrics read from the dataset
+// provided by Westermo have the fields of WestermoSchema, metrics from other collectors can have any fields.
 // See: https://github.com/westermo/test-system-performance-dataset/ for more information.
-// Tags are used to convert parse structs to and from csv and json.
-// A zero value for Metric is not valid.
+// A zero value for Metric is not valid, use NewMetric instead.
 type Metric struct {
-	Timestamp               int64   `csv:"timestamp" json:"timestamp"`
-	Load1m                  float64 `csv:"load-1m" json:"load-1m"`
-	Load5m                  float64 `csv:"load-5m" json:"load-5m"`
-	Load15m                 float64 `csv:"load-15m" json:"load-15m"`
-	Sys_Mem_Swap_Total      int64   `csv:"sys-mem-swap-total" json:"sys-mem-swap-total"`
-	Sys_Mem_Swap_Free       int64   `csv:"sys-mem-swap-free" json:"sys-mem-swap-free"`
-	Sys_Mem_Free            int64   `csv:"sys-mem-free" json:"sys-mem-free"`
-	Sys_Mem_Cache           int64   `csv:"sys-mem-cache" json:"sys-mem-cache"`
-	Sys_Mem_Buffered        int64   `csv:"sys-mem-buffered" json:"sys-mem-buffered"`
-	Sys_Mem_Available       int64   `csv:"sys-mem-available" json:"sys-mem-available"`
-	Sys_Mem_Total           int64   `csv:"sys-mem-total" json:"sys-mem-total"`
-	Sys_Fork_Rate           float64 `csv:"sys-fork-rate" json:"sys-fork-rate"`
-	Sys_Interrupt_Rate      float64 `csv:"sys-interrupt-rate" json:"sys-interrupt-rate"`
-	Sys_Context_Switch_Rate float64 `csv:"sys-context-switch-rate" json:"sys-context-switch-rate"`
-	Sys_Thermal             float64 `csv:"sys-thermal" json:"sys-thermal"`
-	Disk_Io_Time            float64 `csv:"disk-io-time" json:"disk-io-time"`
-	Disk_Bytes_Read         float64 `csv:"disk-bytes-read" json:"disk-bytes-read"`
-	Disk_Bytes_Written      float64 `csv:"disk-bytes-written" json:"disk-bytes-written"`
-	Disk_Io_Read            float64 `csv:"disk-io-read" json:"disk-io-read"`
-	Disk_Io_Write           float64 `csv:"disk-io-write" json:"disk-io-write"`
-	Cpu_Io_Wait             float64 `csv:"cpu-iowait" json:"cpu-iowait"`
-	Cpu_System              float64 `csv:"cpu-system" json:"cpu-system"`
-	Cpu_User                float64 `csv:"cpu-user" json:"cpu-user"`
-	Server_Up               int64   `csv:"server-up" json:"server-up"`
+	Timestamp int64              // Seconds since the start of the metric file, or the unix time once it is written
+	Values    map[string]float64 // The value of every field of the schema by name
+	Schema    *Schema            // The fields of the metric, shared by all metrics of a series
+}
+
+// NewMetric returns a metric with the given schema where every field is 0.
+func NewMetric(schema *Schema, timestamp int64) *Metric {
+	m := Metric{Timestamp: timestamp, Values: make(map[string]float64, len(schema.fields)), Schema: schema}
+	for _, field := range schema.fields {
+		m.Values[field.Name] = 0
+	}
+	return &m
+}
+
+// MetricsFromMaps converts rows of values by field name, e.g. the records of a database query, to metrics that share
+// a schema. The timestamp key is the timestamp of the metric and every other key with a numeric value is a field.
+// Fields that are missing from a row are 0. Fields with int64 values are integer fields.
+func MetricsFromMaps(rows []map[string]interface{}) []*Metric {
+	// The schema is the union of the fields of all rows
+	names, ints := []string{}, map[string]bool{}
+	seen := map[string]bool{}
+	for _, row := range rows {
+		for name, value := range row {
+			_, isNumber := toFloat(value)
+			if name == "timestamp" || !isNumber || seen[name] {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+			_, ints[name] = value.(int64)
+		}
+	}
+	schema := schemaFromNames(names, ints)
+
+	metrics := make([]*Metric, len(rows))
+	for i, row := range rows {
+		timestamp, _ := toFloat(row["timestamp"])
+		metrics[i] = NewMetric(schema, int64(timestamp))
+		for name, value := range row {
+			if f, isNumber := toFloat(value); isNumber && schema.Has(name) {
+				metrics[i].Set(name, f)
+			}
+		}
+	}
+	return metrics
+}
+
+// toFloat converts a numeric value to a float64, the second return value is false if the value is not a number
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// FieldNames returns the names of the fields of the dataset provided by Westermo, the fields of WestermoSchema.
+// The names are returned in the same order as the columns of the dataset. Use the schema of a metric to get its fields.
+func FieldNames() []string {
+	return WestermoSchema.Names()
+}
+
+// Get returns the value of the field with the given name (e.g. "cpu-user").
+// Returns an error if the field is not in the schema of the metric.
+func (m *Metric) Get(name string) (float64, error) {
+	if !m.Schema.Has(name) {
+		return 0, fmt.Errorf("unknown metric field %s", name)
+	}
+	return m.Values[name], nil
+}
+
+// Set sets the value of the field with the given name (e.g. "cpu-user").
+// Integer fields are rounded to the nearest integer.
+// Returns an error if the field is not in the schema of the metric.
+func (m *Metric) Set(name string, value float64) error {
+	if !m.Schema.Has(name) {
+		return fmt.Errorf("unknown metric field %s", name)
+	}
+	if m.Schema.IsInt(name) {
+		value = math.Round(value)
+	}
+	m.Values[name] = value
+	return nil
+}
+
+// Copy returns a copy of the metric that does not share its values with m.
+// Assigning a Metric to another shares the values, so a copy must be used to keep the metric as it was.
+func (m Metric) Copy() Metric {
+	values := make(map[string]float64, len(m.Values))
+	for name, value := range m.Values {
+		values[name] = value
+	}
+	m.Values = values
+	return m
 }
 
 // AnomalyEvent is a struct that contains the information about an anomaly event.
@@ -55,52 +135,48 @@ type Metric struct {
 // might have different information about the anomaly. Providing fields for each of the metrics would be cumbersome and
 // potentially not possible if the anomaly detection algorithm does not have information about all the metrics.
 // This struct is not stored in the database because the string fields are not easily visualized in Grafana.
-// Tags are used to convert parse structs to and from csv.
+// Tags are used to convert parse structs to and from csv and JSON.
 // A zero value for AnomalyEvent is not valid.
 type AnomalyEvent struct {
-	Timestamp int64  `csv:"timestamp"` // Timestamp is the time when the anomaly occurred
-	Host      string `csv:"host"`      // Host is the id of the system where the anomaly occurred
-	Metric    string `csv:"metric"`    // Metric is the metric that triggered the anomaly (if applicable)
-	Comment   string `csv:"comment"`   // Comment is a comment about the anomaly (currently used to identify the algorithm that detected the anomaly)
+	Timestamp int64  `csv:"timestamp" json:"timestamp"` // Timestamp is the time when the anomaly occurred
+	Host      string `csv:"host" json:"host"`           // Host is the id of the system where the anomaly occurred
+	Metric    string `csv:"metric" json:"metric"`       // Metric is the metric that triggered the anomaly (if applicable)
+	Comment   string `csv:"comment" json:"comment"`     // Comment is a comment about the anomaly (currently used to identify the algorithm that detected the anomaly)
 }
 
-// AnomalyDetectionOutput is a struct that contains every metric (same fields as Metric) and whether or not it is an anomaly.
+// AnomalyDetectionOutput is a struct that contains whether every field of a metric is an anomaly.
 // This is intended to be the output of the anomaly detection algorithms and is what is used to store the anomalies
 // in the database. It is not as generic as AnomalyEvent but we found that it was easier to work with.
 // This struct is stored in the database because it contains the same fields as Metric and is easily visualized in Grafana.
-// Tags are used to convert parse structs to and from csv.
 // A zero value for AnomalyDetectionOutput is not valid.
 type AnomalyDetectionOutput struct {
-	Timestamp               int64 `csv:"timestamp"`
-	Load1m                  bool  `csv:"load-1m"`
-	Load5m                  bool  `csv:"load-5m"`
-	Load15m                 bool  `csv:"load-15m"`
-	Sys_Mem_Swap_Total      bool  `csv:"sys-mem-swap-total"`
-	Sys_Mem_Swap_Free       bool  `csv:"sys-mem-swap-free"`
-	Sys_Mem_Free            bool  `csv:"sys-mem-free"`
-	Sys_Mem_Cache           bool  `csv:"sys-mem-cache"`
-	Sys_Mem_Buffered        bool  `csv:"sys-mem-buffered"`
-	Sys_Mem_Available       bool  `csv:"sys-mem-available"`
-	Sys_Mem_Total           bool  `csv:"sys-mem-total"`
-	Sys_Fork_Rate           bool  `csv:"sys-fork-rate"`
-	Sys_Interrupt_Rate      bool  `csv:"sys-interrupt-rate"`
-	Sys_Context_Switch_Rate bool  `csv:"sys-context-switch-rate"`
-	Sys_Thermal             bool  `csv:"sys-thermal"`
-	Disk_Io_Time            bool  `csv:"disk-io-time"`
-	Disk_Bytes_Read         bool  `csv:"disk-bytes-read"`
-	Disk_Bytes_Written      bool  `csv:"disk-bytes-written"`
-	Disk_Io_Read            bool  `csv:"disk-io-read"`
-	Disk_Io_Write           bool  `csv:"disk-io-write"`
-	Cpu_Io_Wait             bool  `csv:"cpu-iowait"`
-	Cpu_System              bool  `csv:"cpu-system"`
-	Cpu_User                bool  `csv:"cpu-user"`
-	Server_Up               bool  `csv:"server-up"`
+	Timestamp int64           // The time of the metric
+	Fields    map[string]bool // Whether every field of the metric is anomalous by name
+}
+
+// Set marks the field with the given name (e.g. "cpu-user") as anomalous or not.
+func (am *AnomalyDetectionOutput) Set(name string, anomalous bool) {
+	if am.Fields == nil {
+		am.Fields = map[string]bool{}
+	}
+	am.Fields[name] = anomalous
+}
+
+// Anomalous returns the names of the fields that are marked as anomalous, sorted by name.
+func (am AnomalyDetectionOutput) Anomalous() []string {
+	names := []string{}
+	for name, anomalous := range am.Fields {
+		if anomalous {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
 }
 
 // The ToMap functions are used to convert structs to maps.
 // They need to be implemented for every struct that is used to store data in the database.
 // This is because the influxdb api requires a map to write to the database.
-// They could probably be implemented in a more generic way using reflections but this works for now.
 
 // ToMap converts a Metric to a map[string]interface{}.
 func (a AnomalyEvent) ToMap() map[string]interface{} {
@@ -113,109 +189,138 @@ func (a AnomalyEvent) ToMap() map[string]interface{} {
 }
 
 // ToMap converts a Metric to a map[string]interface{}.
+// Integer fields are stored as integers so they keep their type in the database.
 func (m Metric) ToMap() map[string]interface{} {
-	return map[string]interface{}{
-		"timestamp":               m.Timestamp,
-		"load-1m":                 m.Load1m,
-		"load-5m":                 m.Load5m,
-		"load-15m":                m.Load15m,
-		"sys-mem-swap-total":      m.Sys_Mem_Swap_Total,
-		"sys-mem-swap-free":       m.Sys_Mem_Swap_Free,
-		"sys-mem-free":            m.Sys_Mem_Free,
-		"sys-mem-cache":           m.Sys_Mem_Cache,
-		"sys-mem-buffered":        m.Sys_Mem_Buffered,
-		"sys-mem-available":       m.Sys_Mem_Available,
-		"sys-mem-total":           m.Sys_Mem_Total,
-		"sys-fork-rate":           m.Sys_Fork_Rate,
-		"sys-interrupt-rate":      m.Sys_Interrupt_Rate,
-		"sys-context-switch-rate": m.Sys_Context_Switch_Rate,
-		"sys-thermal":             m.Sys_Thermal,
-		"disk-io-time":            m.Disk_Io_Time,
-		"disk-bytes-read":         m.Disk_Bytes_Read,
-		"disk-bytes-written":      m.Disk_Bytes_Written,
-		"disk-io-read":            m.Disk_Io_Read,
-		"disk-io-write":           m.Disk_Io_Write,
-		"cpu-iowait":              m.Cpu_Io_Wait,
-		"cpu-system":              m.Cpu_System,
-		"cpu-user":                m.Cpu_User,
-		"server-up":               m.Server_Up,
+	result := make(map[string]interface{}, len(m.Values)+1)
+	result["timestamp"] = m.Timestamp
+	for name, value := range m.Values {
+		if m.Schema.IsInt(name) {
+			result[name] = int64(value)
+		} else {
+			result[name] = value
+		}
+	}
+	return result
+}
+
+// MarshalJSON encodes the metric as a flat JSON object with the timestamp and the fields of its schema in order, e.g.
+// {"timestamp":1,"cpu-user":0.5,"sys-mem-free":1024}. Integer fields are written without a decimal point.
+// Returns an error if a value is NaN or infinite, JSON has no way to represent them.
+func (m Metric) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString(`{"timestamp":`)
+	buffer.WriteString(strconv.FormatInt(m.Timestamp, 10))
+	for _, name := range m.Schema.Names() {
+		value, exists := m.Values[name]
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, fmt.Errorf("field %s has the value %v which can not be written as JSON", name, value)
+		}
+		key, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		buffer.WriteByte(',')
+		buffer.Write(key)
+		buffer.WriteByte(':')
+		if exists {
+			buffer.WriteString(formatValue(&m, name))
+		} else {
+			// Fields a metric does not have are null, they are read as 0
+			buffer.WriteString("null")
+		}
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalJSON decodes a flat JSON object of a metric, see MarshalJSON.
+// If the metric has a schema, only the fields of the schema are read and the others are ignored. Otherwise every key
+// except the timestamp is a field and the schema is taken from the keys like for a JSONLReader. Missing and null values
+// are 0, the values can also be booleans or numbers in strings.
+// Returns an error if the object has no timestamp or a value is not a number.
+func (m *Metric) UnmarshalJSON(data []byte) error {
+	object := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+	if m.Schema == nil {
+		m.Schema = schemaFromObject(object)
+	}
+	metric, err := metricFromObject(object, m.Schema)
+	if err != nil {
+		return err
 	}
+	*m = *metric
+	return nil
 }
 
 // ToMap converts a AnomalyDetectionOutput to a map[string]interface{}.
 func (am AnomalyDetectionOutput) ToMap() map[string]interface{} {
-	return map[string]interface{}{
-		"timestamp":               am.Timestamp,
-		"load-1m":                 am.Load1m,
-		"load-5m":                 am.Load5m,
-		"load-15m":                am.Load15m,
-		"sys-mem-swap-total":      am.Sys_Mem_Swap_Total,
-		"sys-mem-swap-free":       am.Sys_Mem_Swap_Free,
-		"sys-mem-free":            am.Sys_Mem_Free,
-		"sys-mem-cache":           am.Sys_Mem_Cache,
-		"sys-mem-buffered":        am.Sys_Mem_Buffered,
-		"sys-mem-available":       am.Sys_Mem_Available,
-		"sys-mem-total":           am.Sys_Mem_Total,
-		"sys-fork-rate":           am.Sys_Fork_Rate,
-		"sys-interrupt-rate":      am.Sys_Interrupt_Rate,
-		"sys-context-switch-rate": am.Sys_Context_Switch_Rate,
-		"sys-thermal":             am.Sys_Thermal,
-		"disk-io-time":            am.Disk_Io_Time,
-		"disk-bytes-read":         am.Disk_Bytes_Read,
-		"disk-bytes-written":      am.Disk_Bytes_Written,
-		"disk-io-read":            am.Disk_Io_Read,
-		"disk-io-write":           am.Disk_Io_Write,
-		"cpu-iowait":              am.Cpu_Io_Wait,
-		"cpu-system":              am.Cpu_System,
-		"cpu-user":                am.Cpu_User,
-		"server-up":               am.Server_Up,
+	result := make(map[string]interface{}, len(am.Fields)+1)
+	result["timestamp"] = am.Timestamp
+	for name, anomalous := range am.Fields {
+		result[name] = anomalous
 	}
+	return result
 }
 
 // SliceBetween slices the metrics between the startAt time and the duration.
 // The startAt time specifies how far into the metric file we should start the slice.
 // The duration specifies how long the slice should be.
-// If duration is 0, it will return all metrics after the startAt time.
+// If duration is 0, it will return all metrics after the startAt time. A duration longer than the metrics is not an
+// error, the slice simply ends with the metrics, the same as with Between.
 // Will modify the metrics slice in place.
-func (sm *SystemMetric) SliceBetween(startAt, duration time.Duration) {
-	// Find the first and last index of the slice
-	startIndex := 0
-	endIndex := len(sm.Metrics)
-
-	// Check if the duration exceeds the length of the metric file
-	if time.Duration(time.Duration.Seconds(duration+startAt)) > time.Duration(sm.Metrics[len(sm.Metrics)-1].Timestamp) {
-		log.Fatal("Duration exceeds length of the metric file")
+// Returns an error if there are no metrics in the slice, the metrics are not modified in that case.
+func (sm *SystemMetric) SliceBetween(startAt, duration time.Duration) error {
+	to := int64(math.MaxInt64)
+	if duration != 0 {
+		to = int64((startAt + duration).Seconds())
+	}
+	startIndex, endIndex := sm.TimestampBounds(int64(startAt.Seconds()), to)
+	if startIndex == endIndex {
+		return fmt.Errorf("no metrics after %v", startAt)
 	}
+	sm.Metrics = sm.Metrics[startIndex:endIndex]
+	return nil
+}
 
-	// Find the first metric that is after the startAt time
+// TimestampBounds returns the index of the first metric with a timestamp at or after from and the index after the last
+// metric with a timestamp before to. The metrics must be sorted by timestamp.
+// If there are no metrics between from and to, both indexes are the index of the first metric after from.
+func (sm SystemMetric) TimestampBounds(from, to int64) (int, int) {
+	// Find the first and last index of the window
+	startIndex := len(sm.Metrics)
 	for i, m := range sm.Metrics {
-		if time.Second*time.Duration(m.Timestamp) >= startAt {
+		if m.Timestamp >= from {
 			startIndex = i
 			break
 		}
 	}
-
-	// If duration is 0 or the duration is longer than the last metric, return the all metrics after the startAt time
-	lastTimestamp := time.Duration(sm.Metrics[len(sm.Metrics)-1].Timestamp) * time.Second
-	if duration == 0 || startAt+duration >= lastTimestamp {
-		sm.Metrics = sm.Metrics[startIndex:]
-		return
-	}
-
-	// The last metric will be duration time after the startAt time
+	endIndex := len(sm.Metrics)
 	for i, m := range sm.Metrics[startIndex:] {
-		if time.Second*time.Duration(m.Timestamp) >= startAt+duration {
-			endIndex = i
+		if m.Timestamp >= to {
+			endIndex = startIndex + i
 			break
 		}
 	}
 
-	// Slice the metrics between the start and end index
-	sm.Metrics = sm.Metrics[startIndex : startIndex+endIndex]
+	return startIndex, endIndex
 }
 
-// WriteToFile writes a SystemMetric struct to a CSV file.
-// The CSV file will have the same format as the dataset provided by Westermo.
+// Schema returns the schema of the metrics, the schema of the first metric.
+// Returns WestermoSchema if there are no metrics.
+func (sm SystemMetric) Schema() *Schema {
+	if len(sm.Metrics) == 0 || sm.Metrics[0].Schema == nil {
+		return WestermoSchema
+	}
+	return sm.Metrics[0].Schema
+}
+
+// WriteToFile writes a SystemMetric struct to a CSV file, or to a Parquet file if the file ends in .parquet (see
+// WriteParquet) or a JSONL file if it ends in .jsonl (see WriteJSONL). Files ending in .gz or .zst after .csv or
+// .jsonl are compressed, see NewCompressedWriter.
+// The CSV file has a timestamp column followed by a column for every field of the schema of the metrics, so metrics
+// read from the dataset provided by Westermo are written in the same format.
 // Will overwrite the file if it already exists.
 // The Id field of the SystemMetric struct is not used currently.
 // Returns an error if something fails.
@@ -226,55 +331,155 @@ func (sm SystemMetric) WriteToFile(filePath string) error {
 		return err
 	}
 	defer outputFile.Close()
-	err = gocsv.MarshalFile(&sm.Metrics, outputFile)
+	writer, err := NewCompressedWriter(outputFile, filePath)
+	if err != nil {
+		log.Printf("Error when creating file: %v", err)
+		return err
+	}
+	switch {
+	case isParquet(filePath):
+		err = sm.WriteParquet(writer)
+	case IsJSONL(filePath):
+		err = sm.WriteJSONL(writer)
+	default:
+		err = sm.WriteCSV(writer)
+	}
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		log.Printf("Error while parsing metrics from file: %v", err)
+		log.Printf("Error while writing metrics to file: %v", err)
 		return err
 	}
 	return nil
 }
 
-// ReadFromFile reads a CSV file of metrics and returns a SystemMetric struct.
-// The CSV file should have the same format as the dataset provided by Westermo.
+// WriteCSV writes the metrics as CSV to the writer in the same format as WriteToFile.
+// Fields a metric does not have are left empty.
 // Returns an error if something fails.
-func ReadFromFile(filePath string, id string) (*SystemMetric, error) {
-	// Open the file
-	file, err := os.Open(filePath)
+func (sm SystemMetric) WriteCSV(w io.Writer) error {
+	names := sm.Schema().Names()
+	writer := csv.NewWriter(w)
+	if err := writer.Write(append([]string{"timestamp"}, names...)); err != nil {
+		return err
+	}
+	record := make([]string, len(names)+1)
+	for _, m := range sm.Metrics {
+		record[0] = strconv.FormatInt(m.Timestamp, 10)
+		for i, name := range names {
+			record[i+1] = formatValue(m, name)
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// formatValue formats the value of a field for a CSV file, integer fields without a decimal point
+func formatValue(m *Metric, name string) string {
+	value, exists := m.Values[name]
+	switch {
+	case !exists || !m.Schema.Has(name):
+		return ""
+	case m.Schema.IsInt(name):
+		return strconv.FormatInt(int64(value), 10)
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// ReadCSV reads CSV metrics in the same format as ReadFromFile from the reader and returns a SystemMetric struct.
+// The schema of the metrics is taken from the header.
+// Returns an error if the CSV can not be parsed.
+func ReadCSV(r io.Reader, id string) (*SystemMetric, error) {
+	reader, err := NewMetricReader(r, nil)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	return Collect(reader, id)
+}
 
-	// Unmarshal the file into a slice of metrics
-	metrics := []*Metric{}
-	if err := gocsv.UnmarshalFile(file, &metrics); err != nil {
-		panic(err)
+// ReadFromFile reads a CSV, Parquet or JSONL file of metrics and returns a SystemMetric struct, see OpenMetricFile.
+// The file must have a timestamp column, like the dataset provided by Westermo. If schema is nil, every other
+// column is a field of the metrics, otherwise the metrics have the fields of the schema, see NewMetricReader.
+// The whole file is held in memory, use OpenMetricFile to read large files one metric at a time.
+// Returns an error if something fails.
+func ReadFromFile(filePath string, id string, schema *Schema) (*SystemMetric, error) {
+	reader, err := OpenMetricFile(filePath, schema)
+	if err != nil {
+		return nil, err
 	}
+	defer reader.Close()
 
-	// Create a SystemMetric struct and add the id and metrics
-	var systemMetrics = SystemMetric{Id: id, Metrics: metrics}
-
-	return &systemMetrics, nil
+	metrics, err := Collect(reader, id)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+	return metrics, nil
 }
 
 // ParseAnomalyDetectionOutputCSV parses a CSV file of AnomalyDetectionOutput structs and returns a slice of AnomalyDetectionOutput structs.
-// The CSV file should have the same format as the AnomalyDetectionOutput struct.
+// The CSV file should have a timestamp column and a column for every field that was checked for anomalies.
+// The fields can be true or false, yes or no, or numbers where anything but 0 is an anomaly. Empty cells are false.
 // Returns an error if something fails.
 func ParseAnomalyDetectionOutputCSV(filename, host string) (*[]AnomalyDetectionOutput, error) {
-	anomalyData := []AnomalyDetectionOutput{}
 	inputFile, err := os.OpenFile(filename, os.O_RDONLY, os.ModePerm)
 	if err != nil {
 		log.Printf("Error when opening file: %v", err)
 		return nil, err
 	}
 	defer inputFile.Close()
-	if err = gocsv.UnmarshalFile(inputFile, &anomalyData); err != nil {
+
+	records, err := csv.NewReader(inputFile).ReadAll()
+	if err != nil {
 		log.Printf("Error when parsing anomaly detection csv: '%v'", err)
 		return nil, err
 	}
-	if len(anomalyData) == 0 {
+	if len(records) < 2 {
 		return nil, fmt.Errorf("output of anomaly detection is empty")
 	}
 
+	header := records[0]
+	anomalyData := make([]AnomalyDetectionOutput, len(records)-1)
+	for i, record := range records[1:] {
+		output := AnomalyDetectionOutput{Fields: map[string]bool{}}
+		for j, name := range header {
+			name = strings.TrimSpace(name)
+			if j >= len(record) {
+				break
+			}
+			cell := strings.TrimSpace(record[j])
+			if name == "timestamp" {
+				if output.Timestamp, err = parseInt(cell); err != nil {
+					return nil, fmt.Errorf("%s: line %d: invalid timestamp '%s'", filename, i+2, cell)
+				}
+				continue
+			}
+			if output.Fields[name], err = parseBool(cell); err != nil {
+				return nil, fmt.Errorf("%s: line %d: invalid value '%s' for %s", filename, i+2, cell, name)
+			}
+		}
+		anomalyData[i] = output
+	}
+
 	return &anomalyData, nil
 }
+
+// parseBool parses the text of a CSV cell as a boolean the same way for every anomaly detection algorithm
+func parseBool(text string) (bool, error) {
+	switch {
+	case text == "" || strings.EqualFold(text, "no"):
+		return false, nil
+	case strings.EqualFold(text, "yes"):
+		return true, nil
+	}
+	if b, err := strconv.ParseBool(text); err == nil {
+		return b, nil
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return false, err
+	}
+	return f != 0, nil
+}
@@ -0,0 +1,528 @@
+package system_metrics
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	goparquet "github.com/fraugster/parquet-go"
+	"github.com/fraugster/parquet-go/parquet"
+)
+
+// testCSV is a CSV of four metrics with two fields, one every minute
+const testCSV = `timestamp,cpu-user,mem-used
+0,0.1,100
+60,0.2,200
+120,0.3,300
+180,0.4,400
+`
+
+// testMetrics returns the metrics of testCSV
+func testMetrics(t *testing.T) *SystemMetric {
+	reader, err := NewMetricReader(strings.NewReader(testCSV), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := Collect(reader, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metrics
+}
+
+// timestamps returns the timestamps of the metrics
+func timestamps(metrics []*Metric) []int64 {
+	result := []int64{}
+	for _, m := range metrics {
+		result = append(result, m.Timestamp)
+	}
+	return result
+}
+
+func TestMetricReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		csv     string
+		schema  *Schema
+		want    []map[string]float64
+		wantErr bool // Whether reading the rows fails
+	}{
+		{
+			name: "header",
+			csv:  testCSV,
+			want: []map[string]float64{{"cpu-user": 0.1, "mem-used": 100}, {"cpu-user": 0.2, "mem-used": 200}, {"cpu-user": 0.3, "mem-used": 300}, {"cpu-user": 0.4, "mem-used": 400}},
+		},
+		{
+			name:   "schema",
+			csv:    "mem-used,timestamp,cpu-user\n100,0,0.5\n",
+			schema: schemaFromNames([]string{"mem-used"}, map[string]bool{"mem-used": true}),
+			want:   []map[string]float64{{"mem-used": 100}},
+		},
+		{
+			name:   "integer written as float",
+			csv:    "timestamp,mem-used\n0,1024.7\n",
+			schema: schemaFromNames([]string{"mem-used"}, map[string]bool{"mem-used": true}),
+			want:   []map[string]float64{{"mem-used": 1024}},
+		},
+		{
+			name: "byte order mark and spaces",
+			csv:  "\ufefftimestamp, cpu-user\n 0 , 0.5 \n",
+			want: []map[string]float64{{"cpu-user": 0.5}},
+		},
+		{
+			name:    "invalid value",
+			csv:     "timestamp,cpu-user\n0,0.5\n60,high\n",
+			want:    []map[string]float64{{"cpu-user": 0.5}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid timestamp",
+			csv:     "timestamp,cpu-user\nnow,0.5\n",
+			want:    []map[string]float64{},
+			wantErr: true,
+		},
+		{
+			name:    "wrong number of columns",
+			csv:     "timestamp,cpu-user\n0,0.5,1\n",
+			want:    []map[string]float64{},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		reader, err := NewMetricReader(strings.NewReader(test.csv), test.schema)
+		if err != nil {
+			t.Errorf("%s: NewMetricReader() error = %v", test.name, err)
+			continue
+		}
+		got := []map[string]float64{}
+		for reader.Next() {
+			got = append(got, reader.Metric().Values)
+		}
+		if err := reader.Err(); (err != nil) != test.wantErr {
+			t.Errorf("%s: Err() = %v, want error %v", test.name, err, test.wantErr)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: metrics = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMetricReaderKeepsMetrics(t *testing.T) {
+	// The metrics stay valid after the next call to Next
+	reader, err := NewMetricReader(strings.NewReader(testCSV), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := []*Metric{}
+	for reader.Next() {
+		metrics = append(metrics, reader.Metric())
+	}
+	if got, want := timestamps(metrics), []int64{0, 60, 120, 180}; !reflect.DeepEqual(got, want) {
+		t.Errorf("timestamps = %v, want %v", got, want)
+	}
+}
+
+func TestBetween(t *testing.T) {
+	tests := []struct {
+		startAt, duration time.Duration
+		want              []int64
+	}{
+		{startAt: 0, duration: 0, want: []int64{0, 60, 120, 180}},
+		{startAt: time.Minute, duration: 0, want: []int64{60, 120, 180}},
+		{startAt: 30 * time.Second, duration: 2 * time.Minute, want: []int64{60, 120}},
+		{startAt: time.Minute, duration: time.Minute, want: []int64{60}},
+		{startAt: 2 * time.Minute, duration: 24 * time.Hour, want: []int64{120, 180}},
+		{startAt: time.Hour, duration: 0, want: []int64{}},
+		{startAt: 10 * time.Second, duration: 20 * time.Second, want: []int64{}},
+	}
+	for _, test := range tests {
+		got, err := Collect(Between(testMetrics(t).Iterator(), test.startAt, test.duration), "test")
+		if err != nil {
+			t.Errorf("Between(%v, %v) error = %v", test.startAt, test.duration, err)
+			continue
+		}
+		if timestamps := timestamps(got.Metrics); !reflect.DeepEqual(timestamps, test.want) {
+			t.Errorf("Between(%v, %v) = %v, want %v", test.startAt, test.duration, timestamps, test.want)
+		}
+	}
+}
+
+func TestPeek(t *testing.T) {
+	tests := []struct {
+		n    int
+		want []int64
+	}{
+		{n: 0, want: []int64{}},
+		{n: 2, want: []int64{0, 60}},
+		{n: 4, want: []int64{0, 60, 120, 180}},
+		{n: 10, want: []int64{0, 60, 120, 180}},
+	}
+	for _, test := range tests {
+		reader, err := NewMetricReader(strings.NewReader(testCSV), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peeked, it, err := Peek(reader, test.n)
+		if err != nil {
+			t.Errorf("Peek(%d) error = %v", test.n, err)
+			continue
+		}
+		if got := timestamps(peeked); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Peek(%d) = %v, want %v", test.n, got, test.want)
+		}
+
+		// The iterator yields the peeked metrics again before the rest
+		all, err := Collect(it, "test")
+		if err != nil {
+			t.Errorf("Peek(%d): Collect() error = %v", test.n, err)
+			continue
+		}
+		if got, want := timestamps(all.Metrics), []int64{0, 60, 120, 180}; !reflect.DeepEqual(got, want) {
+			t.Errorf("Peek(%d): all metrics = %v, want %v", test.n, got, want)
+		}
+	}
+
+	// A reader that fails while peeking returns the error
+	reader, err := NewMetricReader(strings.NewReader("timestamp,cpu-user\n0,0.5\n60,high\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Peek(reader, 2); err == nil {
+		t.Errorf("Peek() of an invalid CSV succeeded, want error")
+	}
+}
+
+func TestSliceBetween(t *testing.T) {
+	tests := []struct {
+		startAt, duration time.Duration
+		want              []int64
+		wantErr           bool
+	}{
+		{startAt: 0, duration: 0, want: []int64{0, 60, 120, 180}},
+		{startAt: time.Minute, duration: 2 * time.Minute, want: []int64{60, 120}},
+		{startAt: 3 * time.Minute, duration: 0, want: []int64{180}},
+
+		// A duration longer than the metrics ends the slice with the metrics, like Between
+		{startAt: time.Minute, duration: 24 * time.Hour, want: []int64{60, 120, 180}},
+		{startAt: 0, duration: 365 * 24 * time.Hour, want: []int64{0, 60, 120, 180}},
+
+		// An empty slice is an error and leaves the metrics as they were
+		{startAt: 4 * time.Minute, duration: 0, want: []int64{0, 60, 120, 180}, wantErr: true},
+		{startAt: 24 * time.Hour, duration: time.Hour, want: []int64{0, 60, 120, 180}, wantErr: true},
+		{startAt: 10 * time.Second, duration: 20 * time.Second, want: []int64{0, 60, 120, 180}, wantErr: true},
+	}
+	for _, test := range tests {
+		metrics := testMetrics(t)
+		err := metrics.SliceBetween(test.startAt, test.duration)
+		if (err != nil) != test.wantErr {
+			t.Errorf("SliceBetween(%v, %v) error = %v, want error %v", test.startAt, test.duration, err, test.wantErr)
+		}
+		if got := timestamps(metrics.Metrics); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("SliceBetween(%v, %v) = %v, want %v", test.startAt, test.duration, got, test.want)
+		}
+	}
+}
+
+func TestMetricReaderColumns(t *testing.T) {
+	cpuUser := schemaFromNames([]string{"cpu-user"}, nil)
+	tests := []struct {
+		name    string
+		csv     string
+		schema  *Schema
+		want    []map[string]float64
+		wantErr bool // Whether opening or reading the CSV fails
+	}{
+		{name: "no timestamp column", csv: "time,cpu-user\n0,0.5\n", wantErr: true},
+		{name: "no timestamp column with schema", csv: "time,cpu-user\n0,0.5\n", schema: cpuUser, wantErr: true},
+		{name: "no column for a field of the schema", csv: "timestamp,cpu-system\n0,0.5\n", schema: cpuUser, wantErr: true},
+		{name: "duplicate column", csv: "timestamp,cpu-user,cpu-user\n0,0.5,0.5\n", wantErr: true},
+		{
+			name: "empty cells",
+			csv:  "timestamp,cpu-user,sys-mem-total\n0,,\n60, 0.5 ,\n",
+			want: []map[string]float64{{"cpu-user": 0, "sys-mem-total": 0}, {"cpu-user": 0.5, "sys-mem-total": 0}},
+		},
+		{
+			name: "extra columns are fields",
+			csv:  "timestamp,cpu-user,cpu-user-0,net-rx\n0,0.5,0.25,1024\n",
+			want: []map[string]float64{{"cpu-user": 0.5, "cpu-user-0": 0.25, "net-rx": 1024}},
+		},
+		{name: "string column without schema", csv: "timestamp,host,cpu-user\n0,foo,0.5\n", wantErr: true},
+		{
+			name:   "string column left out of the schema",
+			csv:    "timestamp,host,cpu-user\n0,foo,0.5\n",
+			schema: cpuUser,
+			want:   []map[string]float64{{"cpu-user": 0.5}},
+		},
+	}
+	for _, test := range tests {
+		var metrics *SystemMetric
+		reader, err := NewMetricReader(strings.NewReader(test.csv), test.schema)
+		if err == nil {
+			metrics, err = Collect(reader, "test")
+		}
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: error = %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		got := []map[string]float64{}
+		for _, m := range metrics.Metrics {
+			got = append(got, m.Values)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: metrics = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// roundTripMetrics returns metrics with an integer and a float field of the dataset provided by Westermo and a field
+// of another dataset
+func roundTripMetrics(t *testing.T) *SystemMetric {
+	schema, err := NewSchema([]Field{{Name: "sys-mem-total", Int: true}, {Name: "cpu-user"}, {Name: "cpu-user-0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := SystemMetric{Id: "test"}
+	for i := 0; i < 3; i++ {
+		m := NewMetric(schema, int64(60*i))
+		m.Values["sys-mem-total"] = float64(1024 * (i + 1))
+		m.Values["cpu-user"] = 0.125 * float64(i)
+		m.Values["cpu-user-0"] = 1.5e-7 * float64(i+1)
+		metrics.Metrics = append(metrics.Metrics, m)
+	}
+	return &metrics
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		extension string
+		magic     string // The first bytes of the file, empty if it is not compressed
+	}{
+		{extension: ".csv"},
+		{extension: ".csv.gz", magic: "\x1f\x8b"},
+		{extension: ".csv.zst", magic: "\x28\xb5\x2f\xfd"},
+		{extension: ".parquet", magic: "PAR1"},
+		{extension: ".jsonl"},
+		{extension: ".jsonl.gz", magic: "\x1f\x8b"},
+		{extension: ".jsonl.zst", magic: "\x28\xb5\x2f\xfd"},
+	}
+	for _, test := range tests {
+		extension := test.extension
+		want := roundTripMetrics(t)
+		filePath := t.TempDir() + "/metrics" + extension
+		if err := want.WriteToFile(filePath); err != nil {
+			t.Errorf("%s: WriteToFile() error = %v", extension, err)
+			continue
+		}
+		content, err := os.ReadFile(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.magic != "" && !strings.HasPrefix(string(content), test.magic) {
+			t.Errorf("%s: the file is not compressed", extension)
+		}
+		got, err := ReadFromFile(filePath, "test", nil)
+		if err != nil {
+			t.Errorf("%s: ReadFromFile() error = %v", extension, err)
+			continue
+		}
+		if !reflect.DeepEqual(got.Schema().Fields(), want.Schema().Fields()) {
+			t.Errorf("%s: fields = %v, want %v", extension, got.Schema().Fields(), want.Schema().Fields())
+		}
+		if len(got.Metrics) != len(want.Metrics) {
+			t.Errorf("%s: %d metrics, want %d", extension, len(got.Metrics), len(want.Metrics))
+			continue
+		}
+		for i, m := range got.Metrics {
+			if m.Timestamp != want.Metrics[i].Timestamp || !reflect.DeepEqual(m.Values, want.Metrics[i].Values) {
+				t.Errorf("%s: metric %d = %d %v, want %d %v", extension, i, m.Timestamp, m.Values, want.Metrics[i].Timestamp, want.Metrics[i].Values)
+			}
+		}
+	}
+}
+
+// parquetColumn is a column of a Parquet file written by parquetFile
+type parquetColumn struct {
+	name     string
+	kind     string // int64, double, boolean or string
+	optional bool   // Whether the column can be null, a row leaves out the column for a null value
+}
+
+// parquetFile returns a Parquet file with the columns and rows
+func parquetFile(t *testing.T, columns []parquetColumn, rows []map[string]interface{}) []byte {
+	var buffer bytes.Buffer
+	writer := goparquet.NewFileWriter(&buffer)
+	for _, column := range columns {
+		var store *goparquet.ColumnStore
+		var err error
+		switch column.kind {
+		case "int64":
+			store, err = goparquet.NewInt64Store(parquet.Encoding_PLAIN, true, &goparquet.ColumnParameters{})
+		case "double":
+			store, err = goparquet.NewDoubleStore(parquet.Encoding_PLAIN, true, &goparquet.ColumnParameters{})
+		case "boolean":
+			store, err = goparquet.NewBooleanStore(parquet.Encoding_PLAIN, &goparquet.ColumnParameters{})
+		case "string":
+			store, err = goparquet.NewByteArrayStore(parquet.Encoding_PLAIN, true, &goparquet.ColumnParameters{})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		repetition := parquet.FieldRepetitionType_REQUIRED
+		if column.optional {
+			repetition = parquet.FieldRepetitionType_OPTIONAL
+		}
+		if err := writer.AddColumnByPath(goparquet.ColumnPath{column.name}, goparquet.NewDataColumn(store, repetition)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, row := range rows {
+		if err := writer.AddData(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestParquetReaderColumns(t *testing.T) {
+	cpuUser := schemaFromNames([]string{"cpu-user"}, nil)
+	timestamp := parquetColumn{name: "timestamp", kind: "int64"}
+	tests := []struct {
+		name    string
+		columns []parquetColumn
+		rows    []map[string]interface{}
+		schema  *Schema
+		want    []map[string]float64
+		wantErr bool // Whether opening or reading the file fails
+	}{
+		{
+			name:    "no timestamp column",
+			columns: []parquetColumn{{name: "time", kind: "int64"}, {name: "cpu-user", kind: "double"}},
+			rows:    []map[string]interface{}{{"time": int64(0), "cpu-user": 0.5}},
+			wantErr: true,
+		},
+		{
+			name:    "no timestamp column with schema",
+			columns: []parquetColumn{{name: "time", kind: "int64"}, {name: "cpu-user", kind: "double"}},
+			rows:    []map[string]interface{}{{"time": int64(0), "cpu-user": 0.5}},
+			schema:  cpuUser,
+			wantErr: true,
+		},
+		{
+			name:    "no column for a field of the schema",
+			columns: []parquetColumn{timestamp, {name: "cpu-system", kind: "double"}},
+			rows:    []map[string]interface{}{{"timestamp": int64(0), "cpu-system": 0.5}},
+			schema:  cpuUser,
+			wantErr: true,
+		},
+		{
+			name:    "null values",
+			columns: []parquetColumn{timestamp, {name: "cpu-user", kind: "double", optional: true}, {name: "sys-mem-total", kind: "int64", optional: true}},
+			rows:    []map[string]interface{}{{"timestamp": int64(0)}, {"timestamp": int64(60), "cpu-user": 0.5, "sys-mem-total": int64(1024)}},
+			want:    []map[string]float64{{"cpu-user": 0, "sys-mem-total": 0}, {"cpu-user": 0.5, "sys-mem-total": 1024}},
+		},
+		{
+			name:    "boolean column",
+			columns: []parquetColumn{timestamp, {name: "server-up", kind: "boolean"}},
+			rows:    []map[string]interface{}{{"timestamp": int64(0), "server-up": true}, {"timestamp": int64(60), "server-up": false}},
+			want:    []map[string]float64{{"server-up": 1}, {"server-up": 0}},
+		},
+		{
+			name:    "string column without schema",
+			columns: []parquetColumn{timestamp, {name: "host", kind: "string"}, {name: "cpu-user", kind: "double"}},
+			rows:    []map[string]interface{}{{"timestamp": int64(0), "host": []byte("foo"), "cpu-user": 0.5}},
+			wantErr: true,
+		},
+		{
+			name:    "string column left out of the schema",
+			columns: []parquetColumn{timestamp, {name: "host", kind: "string"}, {name: "cpu-user", kind: "double"}},
+			rows:    []map[string]interface{}{{"timestamp": int64(0), "host": []byte("foo"), "cpu-user": 0.5}},
+			schema:  cpuUser,
+			want:    []map[string]float64{{"cpu-user": 0.5}},
+		},
+	}
+	for _, test := range tests {
+		var metrics *SystemMetric
+		reader, err := NewParquetReader(bytes.NewReader(parquetFile(t, test.columns, test.rows)), test.schema)
+		if err == nil {
+			metrics, err = Collect(reader, "test")
+		}
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: error = %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		got := []map[string]float64{}
+		for _, m := range metrics.Metrics {
+			got = append(got, m.Values)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: metrics = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestJSONLReaderColumns(t *testing.T) {
+	cpuUser := schemaFromNames([]string{"cpu-user"}, nil)
+	tests := []struct {
+		name    string
+		jsonl   string
+		schema  *Schema
+		want    []map[string]float64
+		wantErr bool // Whether opening or reading the JSONL fails
+	}{
+		{name: "no timestamp", jsonl: `{"time":0,"cpu-user":0.5}`, wantErr: true},
+		{name: "no timestamp with schema", jsonl: `{"time":0,"cpu-user":0.5}`, schema: cpuUser, wantErr: true},
+		{name: "no timestamp after the first line", jsonl: "{\"timestamp\":0,\"cpu-user\":0.5}\n{\"cpu-user\":0.5}", wantErr: true},
+		{name: "no field of the schema", jsonl: `{"timestamp":0,"cpu-system":0.5}`, schema: cpuUser, wantErr: true},
+		{
+			name:  "null and missing values",
+			jsonl: "{\"timestamp\":0,\"cpu-user\":null,\"sys-mem-total\":null}\n\n{\"timestamp\":60,\"sys-mem-total\":1024}",
+			want:  []map[string]float64{{"cpu-user": 0, "sys-mem-total": 0}, {"cpu-user": 0, "sys-mem-total": 1024}},
+		},
+		{
+			name:  "booleans and numbers in strings",
+			jsonl: `{"timestamp":"0","server-up":true,"cpu-user":" 0.5 "}`,
+			want:  []map[string]float64{{"server-up": 1, "cpu-user": 0.5}},
+		},
+		{name: "string value without schema", jsonl: `{"timestamp":0,"host":"foo","cpu-user":0.5}`, wantErr: true},
+		{name: "object value", jsonl: `{"timestamp":0,"cpu-user":{"value":0.5}}`, wantErr: true},
+		{
+			name:   "string value left out of the schema",
+			jsonl:  `{"timestamp":0,"host":"foo","cpu-user":0.5}`,
+			schema: cpuUser,
+			want:   []map[string]float64{{"cpu-user": 0.5}},
+		},
+	}
+	for _, test := range tests {
+		var metrics *SystemMetric
+		reader, err := NewJSONLReader(strings.NewReader(test.jsonl), test.schema)
+		if err == nil {
+			metrics, err = Collect(reader, "test")
+		}
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: error = %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		got := []map[string]float64{}
+		for _, m := range metrics.Metrics {
+			got = append(got, m.Values)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: metrics = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -8,8 +8,11 @@ from sklearn.preprocessing import StandardScaler
 
 
 def read_file(file_path):
-    # Read CSV file
-    df = pd.read_csv(file_path)
+    # Read Parquet or CSV file, nala hands the metrics over as Parquet
+    if file_path.endswith(".parquet"):
+        df = pd.read_parquet(file_path)
+    else:
+        df = pd.read_csv(file_path)
 
     return df
 
@@ -17,7 +20,11 @@ def read_file(file_path):
 def train_prediction_IF(
     dataframe, feature, no_of_tree=1000, perchentage_of_outlier=0.01
 ):
-    df = pd.DataFrame({"server-up": dataframe["server-up"], "feature": feature})
+    # server-up is only used if the metrics have it, the schema of the metrics can vary
+    if "server-up" in dataframe.columns:
+        df = pd.DataFrame({"server-up": dataframe["server-up"], "feature": feature})
+    else:
+        df = pd.DataFrame({"feature": feature})
 
     scaler = StandardScaler()
     df_scaled = scaler.fit_transform(df)
@@ -56,7 +63,8 @@ def sum_all_annomaly_in_outpuDF(input_df, anomalies_2D):
     ]
 
     df_anomaly = pd.DataFrame(columns=input_df.columns)
-    df_anomaly[["timestamp", "server-up"]] = input_df[["timestamp", "server-up"]].copy()
+    kept_columns = [column for column in ["timestamp", "server-up"] if column in input_df.columns]
+    df_anomaly[kept_columns] = input_df[kept_columns].copy()
     anomaly_index = 0
     for column in df_anomaly.columns:
         if column not in ["timestamp", "server-up"]:
@@ -41,7 +41,8 @@ func NewAnomalyDetectionParameters(dbapi influxdbapi.InfluxDBApi, host string, d
 }
 
 // isolationForest is an anomaly detection function that uses the Isolation Forest algorithm implemented in Python.
-// It writes the metrics to a csv file, then calls the Python script that runs the Isolation Forest algorithm on the csv file.
+// It writes the metrics to a Parquet file, then calls the Python script that runs the Isolation Forest algorithm on the Parquet file.
+// Parquet is used instead of CSV since it is much faster to write and for pandas to read.
 // The output of the python script is then parsed and returned.
 // For more information about the details of the Isolation Forest algorithm, see the documentation of the Python script.
 // Requires certain Python packages to be installed, these are listed in the requirements.txt file.
@@ -51,7 +52,7 @@ func NewAnomalyDetectionParameters(dbapi influxdbapi.InfluxDBApi, host string, d
 func isolationForest(ad *AnomalyDetectionParameters) (*[]system_metrics.AnomalyDetectionOutput, error) {
 	log.Println("Starting anomaly detection with Isolation Forest")
 
-	inputFilePath := "/tmp/input.csv"
+	inputFilePath := "/tmp/input.parquet"
 	outputFilePath := "/tmp/output.csv"
 	log.Println("Writing data to file")
 
@@ -7,7 +7,6 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
-	"reflect"
 	"strings"
 
 	"github.com/gocarina/gocsv"
@@ -20,6 +19,9 @@ import (
 // FIXME: This is not thread safe, but it should be fine for what we are doing. We could probably use a mutex to make it thread safe.
 var inProgress = false
 
+// defaultAnomalyLog is the file the anomalies are logged to if NALA_ANOMALY_LOG is not set
+const defaultAnomalyLog = "/tmp/anomalies.csv"
+
 func triggerDetection(ctx *gin.Context) {
 	log.Println("Anomaly detection request received!")
 	algorithm := ctx.Param("algorithm")
@@ -82,7 +84,11 @@ func triggerDetection(ctx *gin.Context) {
 			return
 		}
 		log.Println("Logging anomalies to file")
-		if err = logAnomalies("/tmp/anomalies.csv", host, algorithm, *anomalies); err != nil {
+		anomalyLog, exists := os.LookupEnv("NALA_ANOMALY_LOG")
+		if !exists {
+			anomalyLog = defaultAnomalyLog
+		}
+		if err = logAnomalies(anomalyLog, host, algorithm, *anomalies); err != nil {
 			log.Printf("Error when writing anomalies to file: %v\n", err)
 			return
 		}
@@ -123,7 +129,9 @@ func pythonSmokeTest() {
 }
 
 // logAnomalies takes a slice of AnomalyDetectionOutput structs, converts it to AnomalyEvent structs and writes it to a log file.
-// The format of the log file is defined by the AnomalyEvent struct.
+// The format of the log file is defined by the AnomalyEvent struct. The file is written as JSONL (one JSON object per
+// line) if filePath is a JSONL file (see IsJSONL), so log pipelines can ingest it directly, and as CSV otherwise.
+// Files ending in .gz or .zst are compressed, see NewCompressedWriter.
 // The log file is written to the path specified by filePath.
 // If the file does not exist, it will be created, if it does exist, it will be appended to.
 // Returns an error if any of the steps fail.
@@ -131,17 +139,10 @@ func logAnomalies(filePath string, host string, algorithm string, data []system_
 	// Convert the AnomalyDetectionOutput structs to AnomalyEvent structs
 	outputArray := []system_metrics.AnomalyEvent{}
 	for _, v := range data {
-		// Use reflection to get the fields of the struct
-		r := reflect.ValueOf(v)
-
-		// Iterate over the fields and if any value is true, add it to the output array as an AnomalyEvent
+		// Every anomalous field is added to the output array as an AnomalyEvent
 		// This means any single AnomalyDetectionOutput struct can result in multiple AnomalyEvent structs
-		// Skip the first field (Timestamp) because it is not a bool
-		for i := 1; i < r.NumField(); i++ {
-			if r.Field(i).Interface() == true {
-				// Get the name of the CSV tag of the field, this is the name of the metric
-				outputArray = append(outputArray, system_metrics.AnomalyEvent{Timestamp: v.Timestamp, Host: host, Metric: r.Type().Field(i).Tag.Get("csv"), Comment: algorithm})
-			}
+		for _, field := range v.Anomalous() {
+			outputArray = append(outputArray, system_metrics.AnomalyEvent{Timestamp: v.Timestamp, Host: host, Metric: field, Comment: algorithm})
 		}
 	}
 
@@ -154,7 +155,19 @@ func logAnomalies(filePath string, host string, algorithm string, data []system_
 	defer outputFile.Close()
 
 	// Write the AnomalyEvent structs to the file
-	err = gocsv.MarshalFile(&outputArray, outputFile)
+	writer, err := system_metrics.NewCompressedWriter(outputFile, filePath)
+	if err != nil {
+		log.Printf("Error when creating file: %v", err)
+		return err
+	}
+	if system_metrics.IsJSONL(filePath) {
+		err = system_metrics.WriteJSONL(writer, outputArray)
+	} else {
+		err = gocsv.Marshal(&outputArray, writer)
+	}
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		log.Printf("Error while parsing metrics from file: %v", err)
 		return err
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"compress/gzip"
+	"internal/system_metrics"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLogAnomaliesJSONL(t *testing.T) {
+	first := []system_metrics.AnomalyDetectionOutput{
+		{Timestamp: 60, Fields: map[string]bool{"cpu-user": true, "cpu-system": false, "load-1m": true}},
+		{Timestamp: 120, Fields: map[string]bool{"cpu-user": false}},
+	}
+	second := []system_metrics.AnomalyDetectionOutput{
+		{Timestamp: 180, Fields: map[string]bool{"sys-mem-free": true}},
+	}
+	// The events are written in the order of the outputs, the fields of an output sorted by name
+	want := []system_metrics.AnomalyEvent{
+		{Timestamp: 60, Host: "foo", Metric: "cpu-user", Comment: "lstm"},
+		{Timestamp: 60, Host: "foo", Metric: "load-1m", Comment: "lstm"},
+		{Timestamp: 180, Host: "foo", Metric: "sys-mem-free", Comment: "lstm"},
+	}
+
+	for _, extension := range []string{".jsonl", ".jsonl.gz"} {
+		filePath := t.TempDir() + "/anomalies" + extension
+		// A second log is appended to the first
+		for _, data := range [][]system_metrics.AnomalyDetectionOutput{first, second} {
+			if err := logAnomalies(filePath, "foo", "lstm", data); err != nil {
+				t.Fatalf("%s: logAnomalies() error = %v", extension, err)
+			}
+		}
+
+		file, err := os.Open(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reader io.Reader = file
+		if strings.HasSuffix(extension, ".gz") {
+			// Every appended log is a gzip member of its own, they are read one after the other
+			if reader, err = gzip.NewReader(file); err != nil {
+				file.Close()
+				t.Fatalf("%s: the log is not compressed: %v", extension, err)
+			}
+		}
+		got, err := system_metrics.ReadJSONL[system_metrics.AnomalyEvent](reader)
+		file.Close()
+		if err != nil {
+			t.Fatalf("%s: ReadJSONL() error = %v", extension, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: events = %v, want %v", extension, got, want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"internal/influxdbapi"
+	"internal/system_metrics"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// placementAttempts is how many random positions are tried for an anomaly before the campaign gives up on placing it
+const placementAttempts = 1000
+
+// CampaignManifest describes what a campaign injected where, it is written as JSON next to the filled data.
+// The times of the anomalies are the absolute times they were written at so they can be looked up in the database.
+type CampaignManifest struct {
+	Seed      int64               `json:"seed"`      // The seed the campaign was run with, running the campaign again with it gives the same placements
+	Hosts     []string            `json:"hosts"`     // The simulated hosts
+	Anomalies []CampaignPlacement `json:"anomalies"` // The placed anomalies ordered by host and start time
+}
+
+// CampaignPlacement is an anomaly placed by a campaign.
+type CampaignPlacement struct {
+	Host     string    `json:"host"`     // The host the anomaly was injected into
+	Anomaly  string    `json:"anomaly"`  // Name of the anomaly
+	Spec     string    `json:"spec"`     // The anomaly spec including the window, the same as the spec field of the ground truth
+	Offset   int64     `json:"offset"`   // How far into the simulation of the host the anomaly starts, in seconds
+	Duration int64     `json:"duration"` // How long the anomaly lasts, in seconds
+	Start    time.Time `json:"start"`    // The absolute time the anomaly starts at
+	End      time.Time `json:"end"`      // The absolute time the anomaly ends at
+}
+
+// Campaign fills the database with metrics from the specified files and injects anomalies at random positions.
+// The count of every anomaly type (see parseCampaignCounts) is placed on randomly chosen hosts with a random duration between the minimum
+// and maximum duration. Anomalies never overlap on the same host.
+// The hosts are filled in parallel the same way as Fill does, including the ground truth of the injected anomalies.
+// All random draws, both the placements and the anomalies themselves, come from the seed so a campaign can be replayed.
+// When all hosts are filled, the manifest of the placed anomalies is written to the manifest file as JSON.
+// Returns an error if the anomalies do not fit in the metrics or if anything goes wrong while filling the database.
+func Campaign(flags CampaignArgs) error {
+	// Initialize the influxdb api
+	var influxDBApi = influxdbapi.NewInfluxDBApi(flags.DBArgs.Token, flags.DBArgs.Host, flags.DBArgs.Port, flags.DBArgs.Org, flags.DBArgs.Bucket, flags.DBArgs.Measurement)
+	defer influxDBApi.Close()
+
+	log.Printf("Running campaign over %v files with seed %v\n", len(flags.Files), flags.Seed)
+
+	// Read and slice all files first, the length of every host is needed to place the anomalies
+	hosts := make([]*system_metrics.SystemMetric, len(flags.Files))
+	for i, file := range flags.Files {
+		metrics, err := system_metrics.ReadFromFile(file, GetIdFromFileName(file), flags.Schema)
+		if err != nil {
+			return err
+		}
+		if err := metrics.SliceBetween(flags.StartAt, flags.Duration); err != nil {
+			return fmt.Errorf("file %s does not contain any metrics to simulate: %v", file, err)
+		}
+		hosts[i] = metrics
+	}
+
+	placements, err := placeAnomalies(hosts, flags)
+	if err != nil {
+		return err
+	}
+
+	// The wait group is used to wait for all goroutines to finish
+	var wg sync.WaitGroup
+	// The errors of the goroutines are collected in a channel with room for one error per host so no goroutine blocks
+	errs := make(chan error, len(hosts))
+
+	for i, metrics := range hosts {
+		wg.Add(1)
+
+		go func(metrics *system_metrics.SystemMetric, placements []CampaignPlacement) {
+			defer wg.Done()
+
+			// The windows of the anomalies are relative to the first metric, which is written at start plus its timestamp
+			origin := metrics.Metrics[0].Timestamp
+			start := influxdbapi.StartTime(*metrics, flags.Gap)
+			specs := make([]string, len(placements))
+			for j := range placements {
+				specs[j] = placements[j].Spec
+				placements[j].Start = start.Add(time.Duration(origin+placements[j].Offset) * time.Second)
+				placements[j].End = placements[j].Start.Add(time.Duration(placements[j].Duration) * time.Second)
+			}
+
+			log.Printf("%v: injecting %v anomalies\n", metrics.Id, len(specs))
+			truths, err := InjectAnomalies(metrics, specs, nil, 0, 0, start, NewRand(flags.Seed, metrics.Id))
+			if err != nil {
+				errs <- fmt.Errorf("%s: %v", metrics.Id, err)
+				return
+			}
+			// Hosts without anomalies are written as they are, like the files of a fill without anomalies
+			if len(specs) > 0 {
+				if err := validateMetrics(metrics, truths, flags.Validate); err != nil {
+					errs <- fmt.Errorf("%s: %v", metrics.Id, err)
+					return
+				}
+			}
+
+			// The ground truth is only written for metrics that are in the database
+			if err := influxDBApi.WriteMetricsFrom(*metrics, start, func() {}); err != nil {
+				errs <- fmt.Errorf("%s: %v", metrics.Id, err)
+				return
+			}
+			for _, truth := range truths {
+				if err := writeGroundTruth(influxDBApi, truth, metrics.Id, start, flags.Seed); err != nil {
+					errs <- fmt.Errorf("%s: %v", metrics.Id, err)
+					return
+				}
+			}
+			log.Printf("%v: finished writing metrics\n", metrics.Id)
+		}(metrics, placements[i])
+	}
+	wg.Wait()
+	close(errs)
+
+	// Return the first error if there is one
+	if err, failed := <-errs; failed {
+		return err
+	}
+
+	// Write the manifest once every host is filled so it only describes data that is actually in the database
+	manifest := CampaignManifest{Seed: flags.Seed, Hosts: []string{}, Anomalies: []CampaignPlacement{}}
+	for i, metrics := range hosts {
+		manifest.Hosts = append(manifest.Hosts, metrics.Id)
+		manifest.Anomalies = append(manifest.Anomalies, placements[i]...)
+	}
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(flags.Manifest, content, 0644); err != nil {
+		return err
+	}
+	log.Printf("Finished campaign, manifest written to %v\n", flags.Manifest)
+	return nil
+}
+
+// placeAnomalies places the count of every anomaly type on random hosts at random positions.
+// The duration of every anomaly is drawn uniformly between the minimum and maximum duration, in whole seconds.
+// Anomalies on the same host never overlap. Returns the placements of every host ordered by their offset.
+// Returns an error if an anomaly could not be placed without overlapping the anomalies that are already placed.
+func placeAnomalies(hosts []*system_metrics.SystemMetric, flags CampaignArgs) ([][]CampaignPlacement, error) {
+	// The placements use their own source so they do not depend on the random draws of the anomalies
+	rng := rand.New(rand.NewSource(flags.Seed))
+
+	placements := make([][]CampaignPlacement, len(hosts))
+	for i, anomaly := range flags.Anomalies {
+		spec, _ := ParseAnomalySpec(anomaly)
+		for n := 0; n < flags.Counts[i]; n++ {
+			placed := false
+			for attempt := 0; attempt < placementAttempts && !placed; attempt++ {
+				host := rng.Intn(len(hosts))
+				metrics := hosts[host].Metrics
+				length := metrics[len(metrics)-1].Timestamp - metrics[0].Timestamp
+
+				minDuration, maxDuration := int64(flags.MinDuration.Seconds()), int64(flags.MaxDuration.Seconds())
+				duration := minDuration + rng.Int63n(maxDuration-minDuration+1)
+				if duration > length {
+					continue
+				}
+				offset := rng.Int63n(length - duration + 1)
+				if overlaps(placements[host], offset, duration) {
+					continue
+				}
+
+				placements[host] = append(placements[host], CampaignPlacement{
+					Host:     hosts[host].Id,
+					Anomaly:  spec.Name,
+					Spec:     withWindow(anomaly, time.Duration(offset)*time.Second, time.Duration(duration)*time.Second),
+					Offset:   offset,
+					Duration: duration,
+				})
+				placed = true
+			}
+			if !placed {
+				return nil, fmt.Errorf("could not place anomaly %s without overlapping other anomalies, use fewer or shorter anomalies", anomaly)
+			}
+		}
+	}
+
+	for _, p := range placements {
+		sort.Slice(p, func(i, j int) bool { return p[i].Offset < p[j].Offset })
+	}
+	return placements, nil
+}
+
+// overlaps returns true if the window starting at offset and lasting duration overlaps any of the placements
+func overlaps(placements []CampaignPlacement, offset, duration int64) bool {
+	for _, p := range placements {
+		if offset < p.Offset+p.Duration && p.Offset < offset+duration {
+			return true
+		}
+	}
+	return false
+}
+
+// withWindow adds the start and duration parameters to an anomaly spec, e.g. spike(factor=2) becomes
+// spike(factor=2,start=1h0m0s,duration=30m0s). The spec must not already set start or duration.
+func withWindow(anomaly string, start, duration time.Duration) string {
+	anomaly = strings.TrimSpace(anomaly)
+	window := fmt.Sprintf("start=%v,duration=%v", start, duration)
+	if !strings.HasSuffix(anomaly, ")") {
+		return anomaly + "(" + window + ")"
+	}
+	if strings.HasSuffix(anomaly, "()") {
+		return strings.TrimSuffix(anomaly, ")") + window + ")"
+	}
+	return strings.TrimSuffix(anomaly, ")") + "," + window + ")"
+}
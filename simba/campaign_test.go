@@ -0,0 +1,88 @@
+package main
+
+import (
+	"internal/system_metrics"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCampaignCounts(t *testing.T) {
+	anomalies := []string{"spike(field=cpu-user)", "memory-leak", "spike(field=load-1m)"}
+	tests := []struct {
+		value   string
+		want    []int
+		wantErr bool
+	}{
+		{value: "1", want: []int{1, 1, 1}},
+		{value: " 3 ", want: []int{3, 3, 3}},
+		{value: "spike=5,memory-leak=2", want: []int{5, 2, 5}},
+		{value: "memory-leak=2", want: []int{1, 2, 1}},
+		{value: " spike = 4 ", want: []int{4, 1, 4}},
+		{value: "0", wantErr: true},
+		{value: "-1", wantErr: true},
+		{value: "spike=0", wantErr: true},
+		{value: "spike", wantErr: true},
+		{value: "spike=x", wantErr: true},
+		{value: "spike=1,spike=2", wantErr: true},
+		{value: "dropout=2", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseCampaignCounts(test.value, anomalies)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseCampaignCounts(%q) error = %v, want error %v", test.value, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseCampaignCounts(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestPlaceAnomalies(t *testing.T) {
+	// Three hosts of a day of metrics, one every minute
+	hosts := make([]*system_metrics.SystemMetric, 3)
+	for i := range hosts {
+		hosts[i] = testMetrics(make([]map[string]float64, 24*60)...)
+		hosts[i].Id = []string{"foo", "bar", "baz"}[i]
+	}
+	anomalies := []string{"spike(field=cpu-user)", "memory-leak"}
+	counts, err := parseCampaignCounts("spike=5,memory-leak=2", anomalies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := CampaignArgs{Anomalies: anomalies, Counts: counts, MinDuration: 10 * time.Minute, MaxDuration: time.Hour, Seed: 42}
+
+	placements, err := placeAnomalies(hosts, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	placed := map[string]int{}
+	for host, hostPlacements := range placements {
+		for i, p := range hostPlacements {
+			placed[p.Anomaly]++
+			if p.Host != hosts[host].Id {
+				t.Errorf("anomaly placed on host %s is listed under %s", p.Host, hosts[host].Id)
+			}
+			if p.Duration < 600 || p.Duration > 3600 {
+				t.Errorf("anomaly %s lasts %ds, want between 600 and 3600", p.Spec, p.Duration)
+			}
+			if i > 0 && overlaps(hostPlacements[:i], p.Offset, p.Duration) {
+				t.Errorf("anomaly %s overlaps another anomaly on host %s", p.Spec, p.Host)
+			}
+		}
+	}
+	if want := map[string]int{"spike": 5, "memory-leak": 2}; !reflect.DeepEqual(placed, want) {
+		t.Errorf("placed %v, want %v", placed, want)
+	}
+
+	// The same seed gives the same placements
+	again, err := placeAnomalies(hosts, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(placements, again) {
+		t.Errorf("placements differ with the same seed")
+	}
+}
@@ -3,13 +3,14 @@ package main
 import (
 	"fmt"
 	"internal/influxdbapi"
+	"internal/system_metrics"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/urfave/cli/v2"
-	"golang.org/x/exp/maps"
 )
 
 // Eeach command has its own struct containing the flags passed to it.
@@ -31,23 +32,36 @@ type DBInfo struct {
 
 // FillArgs is a struct containing the flags passed to the fill command
 type FillArgs struct {
-	DBArgs   DBInfo        // DBInfo struct containing the database information
-	Duration time.Duration // Duration of the simulation
-	StartAt  time.Duration // How far into the file to start the simulation
-	Gap      time.Duration // How much time to leave between the last metric and now for future simulations
-	Anomaly  string        // Which anomaly to use (see error_injection.go)
-	Files    []string      // The CSV files of the metrics to simulate
+	DBArgs          DBInfo                 // DBInfo struct containing the database information
+	Duration        time.Duration          // Duration of the simulation
+	StartAt         time.Duration          // How far into the file to start the simulation
+	Gap             time.Duration          // How much time to leave between the last metric and now for future simulations
+	Anomalies       []string               // Which anomalies to use in the order they are applied (see error_injection.go)
+	AnomalyExprs    []string               // Anomaly expressions applied after the anomalies in the order they are given (see expression.go)
+	AnomalyStart    time.Duration          // How far into the simulation the anomalies start unless set in the anomaly spec
+	AnomalyDuration time.Duration          // How long the anomalies last unless set in the anomaly spec, 0 means until the end of the simulation
+	Seed            int64                  // The seed of the random draws of the anomalies
+	Validate        ValidationMode         // What to do with metrics that are physically impossible after injection (see validation.go)
+	Schema          *system_metrics.Schema // The fields of the metrics, taken from the header of every file if nil
+	Files           []string               // The CSV files of the metrics to simulate
 }
 
 // StreamArgs is a struct containing the flags passed to the stream command
 type StreamArgs struct {
-	DBArgs         DBInfo        // DBInfo struct containing the database information
-	Duration       time.Duration // Duration of the simulation
-	StartAt        time.Duration // How far into the file to start the simulation
-	TimeMultiplier int           // How much to speed up the simulation
-	Append         bool          // Whether to append to the latest metric or not
-	Anomaly        string        // Which anomaly to use (see error_injection.go)
-	File           string        // The CSV file of the metrics to simulate
+	DBArgs          DBInfo                 // DBInfo struct containing the database information
+	Duration        time.Duration          // Duration of the simulation
+	StartAt         time.Duration          // How far into the file to start the simulation
+	TimeMultiplier  int                    // How much to speed up the simulation
+	Append          bool                   // Whether to append to the latest metric or not
+	Anomalies       []string               // Which anomalies to use in the order they are applied (see error_injection.go)
+	AnomalyExprs    []string               // Anomaly expressions applied after the anomalies in the order they are given (see expression.go)
+	AnomalyStart    time.Duration          // How far into the simulation the anomalies start unless set in the anomaly spec
+	AnomalyDuration time.Duration          // How long the anomalies last unless set in the anomaly spec, 0 means until the end of the simulation
+	Seed            int64                  // The seed of the random draws of the anomalies
+	Validate        ValidationMode         // What to do with metrics that are physically impossible after injection (see validation.go)
+	Schema          *system_metrics.Schema // The fields of the metrics, taken from the header of the file if nil
+	File            string                 // The CSV file of the metrics to simulate
+	Id              string                 // The id of the simulated system, the file name is used if empty
 }
 
 // CleanArgs is a struct containing the flags passed to the clean command
@@ -58,6 +72,38 @@ type CleanArgs struct {
 	Hosts    []string      // The hosts to delete metrics from
 }
 
+// ScenarioArgs is a struct containing the flags passed to the scenario run command
+type ScenarioArgs struct {
+	DBArgs   DBInfo         // DBInfo struct containing the database information
+	Scenario *Scenario      // The scenario to run, see scenario.go
+	Stream   bool           // Whether to stream the last segment of every host, overrides the stream field of the scenario if set
+	Seed     int64          // The seed of the random draws of the anomalies, overrides the seed field of the scenario if set
+	Validate ValidationMode // What to do with metrics that are physically impossible after injection (see validation.go)
+}
+
+// CampaignArgs is a struct containing the flags passed to the campaign command
+type CampaignArgs struct {
+	DBArgs      DBInfo                 // DBInfo struct containing the database information
+	Duration    time.Duration          // Duration of the simulation
+	StartAt     time.Duration          // How far into the files to start the simulation
+	Gap         time.Duration          // How much time to leave between the last metric and now for future simulations
+	Anomalies   []string               // The anomaly types to place, anomaly specs without a window
+	Counts      []int                  // How many anomalies of each of the Anomalies to place across all hosts
+	MinDuration time.Duration          // The shortest duration of a placed anomaly
+	MaxDuration time.Duration          // The longest duration of a placed anomaly
+	Seed        int64                  // The seed of the placements and the random draws of the anomalies
+	Validate    ValidationMode         // What to do with metrics that are physically impossible after injection (see validation.go)
+	Schema      *system_metrics.Schema // The fields of the metrics, taken from the header of every file if nil
+	Manifest    string                 // The file the manifest of the placed anomalies is written to
+	Files       []string               // The CSV files of the metrics to simulate
+}
+
+// AnomaliesArgs is a struct containing the flags passed to the anomalies list and describe commands
+type AnomaliesArgs struct {
+	JSON bool   // Whether to print the anomalies as JSON
+	Name string // The anomaly to describe, not used by list
+}
+
 // Common flags for the fill and stream commands
 // V2 of urfave/cli does not support shared flags so to avoid duplication we define them here and pass them to the commands
 // FIXME: Use shared flags when (if) they are implemented in V3
@@ -78,15 +124,43 @@ var simulateFlags = []cli.Flag{
 			"s",
 		},
 	},
-	&cli.StringFlag{
+	&cli.StringSliceFlag{
 		Name: "anomaly",
-		// This adds the available anomalies to the help text in kind of a hacky way
-		Usage: "Select which type of anomaly to use. Available: " + strings.Join(maps.Keys(AnomalyMap), ", "),
-		Value: "",
+		Usage: "Select which type of anomaly to use, parameters can be given as name(key=value,...). " +
+			"Can be repeated to apply several anomalies in order. See 'simba anomalies list' for the available anomalies.",
 		Aliases: []string{
 			"a",
 		},
 	},
+	&cli.StringSliceFlag{
+		Name: "anomaly-expr",
+		Usage: "Inject an anomaly given as an expression over the metric fields, the elapsed time t and math functions, " +
+			"e.g. 'cpu-user = min(1, cpu-user*1.8 + 0.05*sin(t/300))'. Can be repeated. Applied after the anomalies of the anomaly flag.",
+	},
+	&cli.StringFlag{
+		Name:  "anomaly-start",
+		Usage: "How far into the simulation the anomaly should start. Duration string. Can be overridden per anomaly with the start parameter.",
+		Value: "",
+	},
+	&cli.StringFlag{
+		Name:  "anomaly-duration",
+		Usage: "How long the anomaly should last. Lasts until the end of the simulation if not set. Duration string. Can be overridden per anomaly with the duration parameter.",
+		Value: "",
+	},
+	&cli.Int64Flag{
+		Name:  "seed",
+		Usage: "Seed for the random draws of the anomalies. A run with the same seed and flags is replayed exactly. A random seed is used and printed if not set.",
+	},
+	&cli.StringFlag{
+		Name:  "validate",
+		Usage: "What to do with metrics that are physically impossible after injecting anomalies, e.g. cpu-user + cpu-system above 1: warn, fail or clamp.",
+		Value: "warn",
+	},
+	&cli.StringFlag{
+		Name:  "schema",
+		Usage: "JSON file listing the fields of the metrics, other columns are ignored. The fields are taken from the header of the CSV files if not set.",
+		Value: "",
+	},
 	&cli.StringFlag{
 		Name:     "db-token",
 		EnvVars:  []string{"INFLUXDB_TOKEN"},
@@ -175,6 +249,24 @@ var App = &cli.App{
 		},
 	},
 	EnableBashCompletion: true,
+	// The anomaly specs contain commas so slice flags must not be split on them
+	DisableSliceFlagSeparator: true,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "plugin-dir",
+			Usage:   "The directory to load anomaly plugins from, no plugins are loaded if it is not set",
+			EnvVars: []string{pluginDirEnv},
+		},
+	},
+	// The plugins are registered before any command runs so they can be used like the built-in anomalies
+	Before: func(ctx *cli.Context) error {
+		if dir := ctx.String("plugin-dir"); dir != "" {
+			if err := RegisterPlugins(dir); err != nil {
+				return cli.Exit(err, 1)
+			}
+		}
+		return nil
+	},
 	// Commands are defined here
 	// Add a new command by adding a new Command struct to the slice
 	Commands: []*cli.Command{
@@ -242,6 +334,290 @@ var App = &cli.App{
 				Value: false,
 			}),
 		},
+		{
+			Name:      "campaign",
+			Usage:     "Fill the database with data from file(s) and inject anomalies at random positions",
+			ArgsUsage: "<file1> <file2> ...",
+			Description: "Places count anomalies of every given type at random, non-overlapping positions across the hosts.\n" +
+				"The count can be a number for every type or given per type, e.g. spike=5,memory-leak=2.\n" +
+				"The anomaly specs must not set start or duration, the window of every anomaly is chosen by the campaign.\n" +
+				"A manifest of what was injected where is written as JSON.\n" +
+				"A duration string is a string like 1d, 1h or 1m.",
+			Action: func(ctx *cli.Context) error {
+				// Parse the flags
+				flags, err := ParseCampaignFlags(ctx)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+				// Execute the logic
+				if err := Campaign(*flags); err != nil {
+					return cli.Exit(err, 1)
+				}
+				return nil
+			},
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{
+					Name:  "anomaly",
+					Usage: "Anomaly type to place, parameters can be given as name(key=value,...). Can be repeated. See 'simba anomalies list' for the available anomalies.",
+					Aliases: []string{
+						"a",
+					},
+				},
+				&cli.StringFlag{
+					Name:  "count",
+					Usage: "How many anomalies of each type to place across all hosts, a number or name=count per type, e.g. spike=5,memory-leak=2. Types without a count are placed once.",
+					Value: "1",
+					Aliases: []string{
+						"n",
+					},
+				},
+				&cli.StringFlag{
+					Name:  "min-duration",
+					Usage: "The shortest duration of a placed anomaly. Duration string.",
+					Value: "10m",
+				},
+				&cli.StringFlag{
+					Name:  "max-duration",
+					Usage: "The longest duration of a placed anomaly. Duration string.",
+					Value: "1h",
+				},
+				&cli.StringFlag{
+					Name:  "manifest",
+					Usage: "The file to write the manifest of the placed anomalies to.",
+					Value: "manifest.json",
+					Aliases: []string{
+						"m",
+					},
+				},
+				&cli.Int64Flag{
+					Name:  "seed",
+					Usage: "Seed for the placements and the random draws of the anomalies. A random seed is used and printed if not set.",
+				},
+				&cli.StringFlag{
+					Name:  "validate",
+					Usage: "What to do with metrics that are physically impossible after injecting anomalies, e.g. cpu-user + cpu-system above 1: warn, fail or clamp.",
+					Value: "warn",
+				},
+				&cli.StringFlag{
+					Name:  "schema",
+					Usage: "JSON file listing the fields of the metrics, other columns are ignored. The fields are taken from the header of the CSV files if not set.",
+					Value: "",
+				},
+				&cli.StringFlag{
+					Name:  "duration",
+					Usage: "How long the simulation should run. Duration string.",
+					Value: "",
+					Aliases: []string{
+						"d",
+					},
+				},
+				&cli.StringFlag{
+					Name:  "start-at",
+					Usage: "How far into the files to start the simulation. Duration string.",
+					Value: "",
+					Aliases: []string{
+						"s",
+					},
+				},
+				&cli.StringFlag{
+					Name:  "gap",
+					Usage: "The time to leave between the last metric and now for future simulations.",
+					Value: "",
+					Aliases: []string{
+						"g",
+					},
+				},
+				&cli.StringFlag{
+					Name:     "db-token",
+					EnvVars:  []string{"INFLUXDB_TOKEN"},
+					Usage:    "InfluxDB token",
+					Value:    "",
+					Category: "Database",
+					Aliases: []string{
+						"T",
+					},
+				},
+				&cli.StringFlag{
+					Name:     "db-host",
+					EnvVars:  []string{"INFLUXDB_HOST"},
+					Usage:    "InfluxDB hostname",
+					Value:    "localhost",
+					Category: "Database",
+					Aliases: []string{
+						"H",
+					},
+				},
+				&cli.StringFlag{
+					Name:     "db-port",
+					EnvVars:  []string{"INFLUXDB_PORT"},
+					Usage:    "InfluxDB port",
+					Value:    "8086",
+					Category: "Database",
+					Aliases: []string{
+						"P",
+					},
+				},
+				&cli.StringFlag{
+					Name:     "db-org",
+					Usage:    "InfluxDB organization",
+					EnvVars:  []string{"INFLUXDB_ORG"},
+					Value:    "pdc-mad",
+					Category: "Database",
+					Aliases: []string{
+						"O",
+					},
+				},
+				&cli.StringFlag{
+					Name:     "db-bucket",
+					Usage:    "InfluxDB bucket",
+					EnvVars:  []string{"INFLUXDB_BUCKET"},
+					Value:    "pdc-mad",
+					Category: "Database",
+					Aliases: []string{
+						"B",
+					},
+				},
+			},
+		},
+		{
+			Name:  "scenario",
+			Usage: "Run declarative scenarios of one or more hosts described in YAML or JSON files",
+			Subcommands: []*cli.Command{
+				{
+					Name:      "run",
+					Usage:     "Fill the database with the hosts of a scenario and optionally stream the last segment of each host",
+					ArgsUsage: "<scenario file>",
+					Description: "A scenario describes a set of hosts, each with a timeline of segments that are written back-to-back.\n" +
+						"Each segment reads a CSV file and can slice it and inject anomalies into it like the fill command.\n" +
+						"See the documentation for the format of the scenario file.",
+					Action: func(ctx *cli.Context) error {
+						// Parse the flags
+						flags, err := ParseScenarioFlags(ctx)
+						if err != nil {
+							return cli.Exit(err, 1)
+						}
+						// Execute the logic
+						if err := RunScenario(*flags); err != nil {
+							return cli.Exit(err, 1)
+						}
+						return nil
+					},
+					Flags: []cli.Flag{
+						&cli.BoolFlag{
+							Name:  "stream",
+							Usage: "Stream the last segment of every host in real time instead of filling it.",
+							Value: false,
+						},
+						&cli.Int64Flag{
+							Name:  "seed",
+							Usage: "Seed for the random draws of the anomalies. Overrides the seed of the scenario. A random seed is used and printed if neither is set.",
+						},
+						&cli.StringFlag{
+							Name:  "validate",
+							Usage: "What to do with metrics that are physically impossible after injecting anomalies, e.g. cpu-user + cpu-system above 1: warn, fail or clamp.",
+							Value: "warn",
+						},
+						&cli.StringFlag{
+							Name:     "db-token",
+							EnvVars:  []string{"INFLUXDB_TOKEN"},
+							Usage:    "InfluxDB token",
+							Value:    "",
+							Category: "Database",
+							Aliases: []string{
+								"T",
+							},
+						},
+						&cli.StringFlag{
+							Name:     "db-host",
+							EnvVars:  []string{"INFLUXDB_HOST"},
+							Usage:    "InfluxDB hostname",
+							Value:    "localhost",
+							Category: "Database",
+							Aliases: []string{
+								"H",
+							},
+						},
+						&cli.StringFlag{
+							Name:     "db-port",
+							EnvVars:  []string{"INFLUXDB_PORT"},
+							Usage:    "InfluxDB port",
+							Value:    "8086",
+							Category: "Database",
+							Aliases: []string{
+								"P",
+							},
+						},
+						&cli.StringFlag{
+							Name:     "db-org",
+							Usage:    "InfluxDB organization",
+							EnvVars:  []string{"INFLUXDB_ORG"},
+							Value:    "pdc-mad",
+							Category: "Database",
+							Aliases: []string{
+								"O",
+							},
+						},
+						&cli.StringFlag{
+							Name:     "db-bucket",
+							Usage:    "InfluxDB bucket",
+							EnvVars:  []string{"INFLUXDB_BUCKET"},
+							Value:    "pdc-mad",
+							Category: "Database",
+							Aliases: []string{
+								"B",
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "anomalies",
+			Usage: "List and describe the available anomalies, including plugins",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "list",
+					Usage: "List the available anomalies with the fields they change",
+					Action: func(ctx *cli.Context) error {
+						// Execute the logic
+						if err := ListAnomalies(AnomaliesArgs{JSON: ctx.Bool("json")}); err != nil {
+							return cli.Exit(err, 1)
+						}
+						return nil
+					},
+					Flags: []cli.Flag{
+						&cli.BoolFlag{
+							Name:  "json",
+							Usage: "Print the anomalies as JSON",
+							Value: false,
+						},
+					},
+				},
+				{
+					Name:      "describe",
+					Usage:     "Describe an anomaly with its parameters, their defaults and bounds and an example",
+					ArgsUsage: "<anomaly>",
+					Action: func(ctx *cli.Context) error {
+						// Parse the flags
+						if ctx.NArg() == 0 {
+							return cli.Exit("missing anomaly. See -h for help", 1)
+						}
+						// Execute the logic
+						if err := DescribeAnomaly(AnomaliesArgs{JSON: ctx.Bool("json"), Name: ctx.Args().First()}); err != nil {
+							return cli.Exit(err, 1)
+						}
+						return nil
+					},
+					Flags: []cli.Flag{
+						&cli.BoolFlag{
+							Name:  "json",
+							Usage: "Print the anomaly as JSON",
+							Value: false,
+						},
+					},
+				},
+			},
+		},
 		{
 			Name:      "clean",
 			Usage:     "Clean the database of data from host(s) or all hosts.",
@@ -324,7 +700,7 @@ var App = &cli.App{
 				},
 				&cli.StringFlag{
 					Name:     "db-measurement",
-					Usage:    "InfluxDB measurement. Use 'anomalies' to delete anomalies.",
+					Usage:    "InfluxDB measurement. Use 'anomalies' to delete anomalies or 'injected' to delete the ground truth of injected anomalies.",
 					EnvVars:  []string{"INFLUXDB_MEASUREMENT"},
 					Value:    "metrics",
 					Category: "Database",
@@ -337,22 +713,69 @@ var App = &cli.App{
 	},
 }
 
-// checkANomalyString checks if the anomalyString given exists in the AnomalyMap
-// If it does not exist, it returns an error
-func checkAnomalyString(anomalyString string) (string, error) {
-	if anomalyString == "" {
-		return anomalyString, nil
+// checkAnomalyStrings checks if the anomalyStrings given are valid anomaly specs
+// The anomalies have to exist in the AnomalyMap and the parameters have to be valid for that anomaly
+// If any of them is not valid, it returns an error
+func checkAnomalyStrings(anomalyStrings []string) ([]string, error) {
+	for _, anomalyString := range anomalyStrings {
+		// Parse the spec, this checks if the anomaly exists in the AnomalyMap and validates the parameters
+		if _, err := ParseAnomalySpec(anomalyString); err != nil {
+			return anomalyStrings, err
+		}
+	}
+
+	return anomalyStrings, nil
+}
+
+// checkExpressionStrings checks if the expressionStrings given are valid anomaly expressions
+// If any of them is not valid, it returns an error
+func checkExpressionStrings(expressionStrings []string) ([]string, error) {
+	for _, expressionString := range expressionStrings {
+		if _, err := ParseExpression(expressionString); err != nil {
+			return expressionStrings, err
+		}
+	}
+
+	return expressionStrings, nil
+}
+
+// parseAnomalyWindow parses the anomaly-start and anomaly-duration flags shared by the fill and stream commands
+// These are the default window of the anomalies that do not set start or duration in their anomaly spec
+// Returns an error if the duration strings are invalid or if the window is set without an anomaly
+func parseAnomalyWindow(ctx *cli.Context) (time.Duration, time.Duration, error) {
+	start, err := influxdbapi.ParseDurationString(ctx.String("anomaly-start"))
+	if err != nil {
+		return 0, 0, err
 	}
-	// Check if the anomaly exists in the AnomalyMap
-	if _, exists := AnomalyMap[anomalyString]; exists {
-		return anomalyString, nil
+	duration, err := influxdbapi.ParseDurationString(ctx.String("anomaly-duration"))
+	if err != nil {
+		return 0, 0, err
 	}
+	if (start != 0 || duration != 0) && len(ctx.StringSlice("anomaly"))+len(ctx.StringSlice("anomaly-expr")) == 0 {
+		return 0, 0, fmt.Errorf("anomaly-start and anomaly-duration require an anomaly. See -h for help")
+	}
+	return start, duration, nil
+}
 
-	return anomalyString, fmt.Errorf("error injection %s is not implemented", anomalyString)
+// parseSeed returns the seed flag if it is set, otherwise a new seed based on the current time
+func parseSeed(ctx *cli.Context) int64 {
+	if ctx.IsSet("seed") {
+		return ctx.Int64("seed")
+	}
+	return NewSeed()
+}
+
+// parseSchema reads the schema file of the schema flag, see system_metrics.ReadSchemaFile
+// Returns nil if the flag is not set, the fields are then taken from the header of every file
+func parseSchema(ctx *cli.Context) (*system_metrics.Schema, error) {
+	if ctx.String("schema") == "" {
+		return nil, nil
+	}
+	return system_metrics.ReadSchemaFile(ctx.String("schema"))
 }
 
 // ValidateFile validates that the filePath is a valid file
-// Returns an error if the file does not exist, is a directory, is not a .csv file or is empty
+// Returns an error if the file does not exist, is a directory, does not end in one of the MetricFileExtensions or is empty
 func ValidateFile(filePath string) error {
 	// Validate the file exists
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
@@ -362,9 +785,9 @@ func ValidateFile(filePath string) error {
 	if info, err := os.Stat(filePath); err == nil && info.IsDir() {
 		return fmt.Errorf("file %s is a directory", filePath)
 	}
-	// Validate the file is a .csv files
-	if filepath.Ext(filePath) != ".csv" {
-		return fmt.Errorf("file %s is not a .csv file", filePath)
+	// Validate the file is a metric file, see MetricFileExtensions
+	if system_metrics.MetricFileExtension(filePath) == "" {
+		return fmt.Errorf("file %s is not a %s file", filePath, strings.Join(system_metrics.MetricFileExtensions, ", "))
 	}
 	// Validate the file is not empty
 	if info, err := os.Stat(filePath); err == nil && info.Size() == 0 {
@@ -374,10 +797,14 @@ func ValidateFile(filePath string) error {
 }
 
 // GetIdFromFileName returns the ID of a metric from the file name
-// The ID is the base file name without the extension
+// The ID is the base file name without the extension, both extensions of compressed files are removed (foo.csv.gz is foo)
 func GetIdFromFileName(file string) string {
+	extension := system_metrics.MetricFileExtension(file)
+	if extension == "" {
+		extension = filepath.Ext(file)
+	}
 	// Remove the file extension from the base file name
-	return filepath.Base(file)[:len(filepath.Base(file))-len(filepath.Ext(file))]
+	return filepath.Base(file)[:len(filepath.Base(file))-len(extension)]
 
 }
 
@@ -400,7 +827,23 @@ func ParseFillFlags(ctx *cli.Context) (*FillArgs, error) {
 	if err != nil {
 		return nil, err
 	}
-	anomalyString, err := checkAnomalyString(ctx.String("anomaly"))
+	anomalyStrings, err := checkAnomalyStrings(ctx.StringSlice("anomaly"))
+	if err != nil {
+		return nil, err
+	}
+	anomalyExprs, err := checkExpressionStrings(ctx.StringSlice("anomaly-expr"))
+	if err != nil {
+		return nil, err
+	}
+	anomalyStart, anomalyDuration, err := parseAnomalyWindow(ctx)
+	if err != nil {
+		return nil, err
+	}
+	validate, err := ParseValidationMode(ctx.String("validate"))
+	if err != nil {
+		return nil, err
+	}
+	schema, err := parseSchema(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -425,11 +868,17 @@ func ParseFillFlags(ctx *cli.Context) (*FillArgs, error) {
 			Bucket:      ctx.String("db-bucket"),
 			Measurement: "metrics",
 		},
-		Duration: duration,
-		StartAt:  startAt,
-		Gap:      gap,
-		Anomaly:  anomalyString,
-		Files:    files,
+		Duration:        duration,
+		StartAt:         startAt,
+		Gap:             gap,
+		Anomalies:       anomalyStrings,
+		AnomalyExprs:    anomalyExprs,
+		AnomalyStart:    anomalyStart,
+		AnomalyDuration: anomalyDuration,
+		Seed:            parseSeed(ctx),
+		Validate:        validate,
+		Schema:          schema,
+		Files:           files,
 	}, nil
 }
 
@@ -454,7 +903,23 @@ func ParseStreamFlags(ctx *cli.Context) (*StreamArgs, error) {
 	if ctx.Int("time-multiplier") < 1 {
 		return nil, fmt.Errorf("timemultiplier cannot be a lower than 1")
 	}
-	anomalyString, err := checkAnomalyString(ctx.String("anomaly"))
+	anomalyStrings, err := checkAnomalyStrings(ctx.StringSlice("anomaly"))
+	if err != nil {
+		return nil, err
+	}
+	anomalyExprs, err := checkExpressionStrings(ctx.StringSlice("anomaly-expr"))
+	if err != nil {
+		return nil, err
+	}
+	anomalyStart, anomalyDuration, err := parseAnomalyWindow(ctx)
+	if err != nil {
+		return nil, err
+	}
+	validate, err := ParseValidationMode(ctx.String("validate"))
+	if err != nil {
+		return nil, err
+	}
+	schema, err := parseSchema(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -473,12 +938,204 @@ func ParseStreamFlags(ctx *cli.Context) (*StreamArgs, error) {
 			Bucket:      ctx.String("db-bucket"),
 			Measurement: "metrics",
 		},
-		Duration:       duration,
-		StartAt:        startAt,
-		TimeMultiplier: ctx.Int("time-multiplier"),
-		Append:         ctx.Bool("append"),
-		Anomaly:        anomalyString,
-		File:           file,
+		Duration:        duration,
+		StartAt:         startAt,
+		TimeMultiplier:  ctx.Int("time-multiplier"),
+		Append:          ctx.Bool("append"),
+		Anomalies:       anomalyStrings,
+		AnomalyExprs:    anomalyExprs,
+		AnomalyStart:    anomalyStart,
+		AnomalyDuration: anomalyDuration,
+		Seed:            parseSeed(ctx),
+		Validate:        validate,
+		Schema:          schema,
+		File:            file,
+	}, nil
+}
+
+// parseCampaignCounts parses the count flag of the campaign command and returns how many of each anomaly to place.
+// The count is either a number used for every anomaly or a comma separated list of name=count, e.g.
+// spike=5,memory-leak=2, where name is the name of an anomaly type. Anomalies without a count in the list are placed once
+// and an anomaly type given several times with different parameters gets the count of its name for each of them.
+// Returns an error if a count is not a positive number or a name is not one of the anomalies.
+func parseCampaignCounts(value string, anomalyStrings []string) ([]int, error) {
+	counts := make([]int, len(anomalyStrings))
+	if count, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+		if count < 1 {
+			return nil, fmt.Errorf("count cannot be lower than 1")
+		}
+		for i := range counts {
+			counts[i] = count
+		}
+		return counts, nil
+	}
+
+	names := make([]string, len(anomalyStrings))
+	for i, anomalyString := range anomalyStrings {
+		spec, _ := ParseAnomalySpec(anomalyString)
+		names[i] = spec.Name
+		counts[i] = 1
+	}
+	seen := map[string]bool{}
+	for _, part := range strings.Split(value, ",") {
+		name, countString, found := strings.Cut(part, "=")
+		name = strings.TrimSpace(name)
+		count, err := strconv.Atoi(strings.TrimSpace(countString))
+		if !found || err != nil {
+			return nil, fmt.Errorf("invalid count '%s', must be a number or name=count", part)
+		}
+		if count < 1 {
+			return nil, fmt.Errorf("count of %s cannot be lower than 1", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("count of %s is given more than once", name)
+		}
+		seen[name] = true
+		matched := false
+		for i := range names {
+			if names[i] == name {
+				counts[i] = count
+				matched = true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("count given for %s which is not one of the anomalies", name)
+		}
+	}
+	return counts, nil
+}
+
+// ParseCampaignFlags parses the flags passed to the campaign command
+// Returns a CampaignArgs struct containing the parsed flags
+// Returns an error if the flags are invalid
+func ParseCampaignFlags(ctx *cli.Context) (*CampaignArgs, error) {
+	if ctx.String("db-token") == "" {
+		return nil, fmt.Errorf("missing InfluxDB token. See -h for help")
+	}
+	duration, err := influxdbapi.ParseDurationString(ctx.String("duration"))
+	if err != nil {
+		return nil, err
+	}
+	startAt, err := influxdbapi.ParseDurationString(ctx.String("start-at"))
+	if err != nil {
+		return nil, err
+	}
+	gap, err := influxdbapi.ParseDurationString(ctx.String("gap"))
+	if err != nil {
+		return nil, err
+	}
+	minDuration, err := influxdbapi.ParseDurationString(ctx.String("min-duration"))
+	if err != nil {
+		return nil, err
+	}
+	maxDuration, err := influxdbapi.ParseDurationString(ctx.String("max-duration"))
+	if err != nil {
+		return nil, err
+	}
+	if minDuration <= 0 || maxDuration < minDuration {
+		return nil, fmt.Errorf("min-duration must be positive and not longer than max-duration")
+	}
+
+	if len(ctx.StringSlice("anomaly")) == 0 {
+		return nil, fmt.Errorf("missing anomaly. See -h for help")
+	}
+	anomalyStrings, err := checkAnomalyStrings(ctx.StringSlice("anomaly"))
+	if err != nil {
+		return nil, err
+	}
+	counts, err := parseCampaignCounts(ctx.String("count"), anomalyStrings)
+	if err != nil {
+		return nil, err
+	}
+	// The campaign chooses the window of every anomaly so the specs can not set their own
+	for _, anomalyString := range anomalyStrings {
+		spec, _ := ParseAnomalySpec(anomalyString)
+		if spec.Start != nil || spec.Duration != nil || spec.Schedule != nil {
+			return nil, fmt.Errorf("anomaly %s can not set start, duration or schedule in a campaign", anomalyString)
+		}
+	}
+	validate, err := ParseValidationMode(ctx.String("validate"))
+	if err != nil {
+		return nil, err
+	}
+	schema, err := parseSchema(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if ctx.NArg() == 0 {
+		return nil, fmt.Errorf("missing file(s). See -h for help")
+	}
+	// Validate the files
+	files := ctx.Args().Slice()
+	for _, file := range files {
+		if err := ValidateFile(file); err != nil {
+			return nil, err
+		}
+	}
+
+	return &CampaignArgs{
+		DBArgs: DBInfo{
+			Token:       ctx.String("db-token"),
+			Host:        ctx.String("db-host"),
+			Port:        ctx.String("db-port"),
+			Org:         ctx.String("db-org"),
+			Bucket:      ctx.String("db-bucket"),
+			Measurement: "metrics",
+		},
+		Duration:    duration,
+		StartAt:     startAt,
+		Gap:         gap,
+		Anomalies:   anomalyStrings,
+		Counts:      counts,
+		MinDuration: minDuration,
+		MaxDuration: maxDuration,
+		Seed:        parseSeed(ctx),
+		Validate:    validate,
+		Schema:      schema,
+		Manifest:    ctx.String("manifest"),
+		Files:       files,
+	}, nil
+}
+
+// ParseScenarioFlags parses the flags passed to the scenario run command
+// The scenario file is loaded and validated, see LoadScenario
+// Returns a ScenarioArgs struct containing the parsed flags
+// Returns an error if the flags or the scenario are invalid
+func ParseScenarioFlags(ctx *cli.Context) (*ScenarioArgs, error) {
+	if ctx.String("db-token") == "" {
+		return nil, fmt.Errorf("missing InfluxDB token. See -h for help")
+	}
+	if ctx.NArg() == 0 {
+		return nil, fmt.Errorf("missing scenario file. See -h for help")
+	}
+	scenario, err := LoadScenario(ctx.Args().First())
+	if err != nil {
+		return nil, err
+	}
+	// The seed flag takes precedence over the seed of the scenario
+	seed := parseSeed(ctx)
+	if scenario.Seed != nil && !ctx.IsSet("seed") {
+		seed = *scenario.Seed
+	}
+	validate, err := ParseValidationMode(ctx.String("validate"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ScenarioArgs{
+		DBArgs: DBInfo{
+			Token:       ctx.String("db-token"),
+			Host:        ctx.String("db-host"),
+			Port:        ctx.String("db-port"),
+			Org:         ctx.String("db-org"),
+			Bucket:      ctx.String("db-bucket"),
+			Measurement: "metrics",
+		},
+		Scenario: scenario,
+		Stream:   ctx.Bool("stream") || scenario.Stream,
+		Seed:     seed,
+		Validate: validate,
 	}, nil
 }
 
@@ -1,54 +1,97 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"internal/influxdbapi"
 	"internal/system_metrics"
 	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
 	"sync"
+	"text/tabwriter"
 	"time"
 
 	"github.com/schollz/progressbar/v3"
+	"golang.org/x/exp/maps"
 )
 
 // Fill the database with metrics from the specified files.
 // The files are read in parallel and the metrics are written to the database in parallel making this function reasonably fast.
 // The relative timestamps of the metrics will be translated to absolute timestamps based on the time parameters (gap and duration) but their relative order and time difference will be preserved.
-// If the anomaly flag is set, an anomaly transformation will be applied to the metrics before they are written to the database.
-// FIXME: The goroutines might return an error but the function will not return it, potentially causing silent errors.
+// If the anomaly flag is set, the anomaly transformations will be applied in order to the metrics before they are written to the database.
+// The anomaly expressions of the anomaly-expr flag are applied after them.
+// The anomaly start and duration flags can be used to only apply the anomalies to a part of the metrics.
+// The ground truth of the anomalies (which metrics were changed by which anomaly) is written to the injected measurement.
+// The random draws of the anomalies are made from a source seeded with the seed flag, so a fill can be replayed exactly.
+// The metrics are validated after the anomalies are injected, see validateMetrics.
+// Returns the first error of injecting or validating the anomalies of any of the files.
 func Fill(flags FillArgs) error {
 	// Initialize the influxdb api
 	var influxDBApi = influxdbapi.NewInfluxDBApi(flags.DBArgs.Token, flags.DBArgs.Host, flags.DBArgs.Port, flags.DBArgs.Org, flags.DBArgs.Bucket, flags.DBArgs.Measurement)
 	defer influxDBApi.Close()
 
 	log.Printf("Filling database with metrics from %v files\n", len(flags.Files))
+	if len(flags.Anomalies)+len(flags.AnomalyExprs) > 0 {
+		log.Printf("Injecting anomalies with seed %v\n", flags.Seed)
+	}
 
 	// Initialize the progress bar
 	bar := progressbar.Default(int64(len(flags.Files)), "Processing files")
 
 	// The wait group is used to wait for all goroutines to finish
 	var wg sync.WaitGroup
+	// The errors of the goroutines are collected in a channel with room for one error per file so no goroutine blocks
+	errs := make(chan error, len(flags.Files))
 
 	// For each file we create a goroutine that reads and parses the file, then writes the metrics to the database
 	for _, file := range flags.Files {
 		wg.Add(1)
 
-		go func(filePath string, bar *progressbar.ProgressBar) error {
+		go func(filePath string, bar *progressbar.ProgressBar) {
 			defer wg.Done()
 
 			// Get the id from the file name
 			id := GetIdFromFileName(filePath)
 
-			bar.Describe("Reading file " + filePath)
-
-			// Read and parse the file
-			// FIXME: Handle this error
-			metric, _ := system_metrics.ReadFromFile(filePath, id)
+			injecting := len(flags.Anomalies)+len(flags.AnomalyExprs) > 0
+
+			// The anomalies need the whole series to be injected, so the file is only read into memory when injecting.
+			// Otherwise the file is streamed twice, see scanMetrics, so files of any size can be filled.
+			var metric *system_metrics.SystemMetric
+			var count int
+			var last int64
+			if injecting {
+				bar.Describe("Reading file " + filePath)
+
+				// Read and parse the file
+				var err error
+				if metric, err = system_metrics.ReadFromFile(filePath, id, flags.Schema); err != nil {
+					errs <- err
+					return
+				}
 
-			bar.Describe("Slicing metrics")
+				bar.Describe("Slicing metrics")
 
-			// Modify the metrics slice based on the startat and duration parameters
-			// If the parameters are 0, it will return all metrics, so we don't need to check for that
-			metric.SliceBetween(flags.StartAt, flags.Duration)
+				// Modify the metrics slice based on the startat and duration parameters
+				// If the parameters are 0, it will return all metrics, so we don't need to check for that
+				if err := metric.SliceBetween(flags.StartAt, flags.Duration); err != nil {
+					errs <- fmt.Errorf("%s: %v", filePath, err)
+					return
+				}
+				count = len(metric.Metrics)
+				last = metric.Metrics[count-1].Timestamp
+			} else {
+				bar.Describe("Scanning file " + filePath)
+
+				var err error
+				if count, last, err = scanMetrics(filePath, flags.Schema, flags.StartAt, flags.Duration); err != nil {
+					errs <- err
+					return
+				}
+			}
 
 			// Create a channel to send progress updates to the progress bar, this allows us to update the progress bar
 			// when the metrics are being written to the database
@@ -56,15 +99,27 @@ func Fill(flags FillArgs) error {
 			defer close(progressChan)
 
 			// Update the progress bar max value
-			bar.ChangeMax(bar.GetMax() + len(metric.Metrics))
+			bar.ChangeMax(bar.GetMax() + count)
 			// Add one to the progress bar to account for being done with the parsing the file
 			bar.Add(1)
 
-			// If the anomaly flag is set, inject an anomaly into the metrics
-			if len(flags.Anomaly) > 0 {
-				bar.Describe("Injecting anomaly")
-				if err := InjectAnomaly(metric, flags.Anomaly); err != nil {
-					return err
+			// Calculate the time the metrics will be written from before injecting the anomaly
+			// This is the same time that is used to translate the ground truth labels to absolute timestamps
+			start := influxdbapi.StartTimeUntil(last, flags.Gap)
+
+			// If the anomaly or anomaly-expr flag is set, inject the anomalies into the metrics
+			var truths []GroundTruth
+			if injecting {
+				bar.Describe("Injecting anomalies")
+				var err error
+				// Every file gets its own random source since the files are processed in parallel
+				if truths, err = InjectAnomalies(metric, flags.Anomalies, flags.AnomalyExprs, flags.AnomalyStart, flags.AnomalyDuration, start, NewRand(flags.Seed, id)); err != nil {
+					errs <- fmt.Errorf("%s: %v", id, err)
+					return
+				}
+				if err := validateMetrics(metric, truths, flags.Validate); err != nil {
+					errs <- fmt.Errorf("%s: %v", id, err)
+					return
 				}
 			}
 
@@ -78,34 +133,100 @@ func Fill(flags FillArgs) error {
 			bar.Describe("Writing metrics to database")
 
 			// Write the metrics to the database
-			// The WriteMetrics function will call the callback function to update the progress bar every time a metric is written
-			// FIXME: Handle this returning an error
-			influxDBApi.WriteMetrics(*metric, flags.Gap, func() {
+			// The write functions will call the callback function to update the progress bar every time a metric is written
+			onWrite := func() {
 				progressChan <- 1
-			})
-			return nil
+			}
+			if injecting {
+				// The ground truth is only written for metrics that are in the database
+				if err := influxDBApi.WriteMetricsFrom(*metric, start, onWrite); err != nil {
+					errs <- fmt.Errorf("%s: %v", filePath, err)
+					return
+				}
+			} else {
+				reader, err := system_metrics.OpenMetricFile(filePath, flags.Schema)
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer reader.Close()
+				if err := influxDBApi.WriteMetricIterator(id, system_metrics.Between(reader, flags.StartAt, flags.Duration), start, onWrite); err != nil {
+					errs <- fmt.Errorf("%s: %v", filePath, err)
+					return
+				}
+			}
 
+			// Write the ground truth of the injected anomalies next to the metrics
+			bar.Describe("Writing ground truth to database")
+			for _, truth := range truths {
+				if err := writeGroundTruth(influxDBApi, truth, id, start, flags.Seed); err != nil {
+					errs <- fmt.Errorf("%s: %v", id, err)
+					return
+				}
+			}
 		}(file, bar)
 	}
 	// Wait for all goroutines to finish
 	wg.Wait()
 	bar.Finish()
+	close(errs)
+
+	// Return the first error if there is one
+	if err, failed := <-errs; failed {
+		return err
+	}
 	log.Println("Finished filling database")
 	return nil
 }
 
+// scanMetrics reads a metric file one metric at a time and returns how many metrics there are between startAt and
+// startAt+duration (see Between) and the timestamp of the last of them, without holding the file in memory.
+// Fill needs both before it writes the first metric: the time the metrics are written from is calculated from the
+// last timestamp (see StartTimeUntil) and the count is the length of the progress bar. That is why a file filled
+// without anomalies is read twice, once here and once to write the metrics. Reading stops at the end of the window.
+// Returns an error if the file can not be read or if there are no metrics in between.
+func scanMetrics(filePath string, schema *system_metrics.Schema, startAt, duration time.Duration) (int, int64, error) {
+	reader, err := system_metrics.OpenMetricFile(filePath, schema)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer reader.Close()
+
+	count, last := 0, int64(0)
+	metrics := system_metrics.Between(reader, startAt, duration)
+	for metrics.Next() {
+		count++
+		last = metrics.Metric().Timestamp
+	}
+	if err := metrics.Err(); err != nil {
+		return 0, 0, fmt.Errorf("%s: %v", filePath, err)
+	}
+	if count == 0 {
+		return 0, 0, fmt.Errorf("%s: no metrics after %v", filePath, startAt)
+	}
+	return count, last, nil
+}
+
 // Stream metrics one by one from the specified file to the database.
 // The metrics are streamed in order and the time difference between them is preserved.
 // The relative timestamps of the metrics will be translated to absolute timestamps based on the time parameters (gap and duration if set).
 // If the append flag is set, the metrics will be appended to the existing metrics in the database, otherwise the metric will be inserted at the current time.
 // The time multiplier flag can be used to speed up the streaming process.
-// If the anomaly flag is set, an anomaly transformation will be applied to the metrics before they are written to the database.
+// If the anomaly flag is set, the anomaly transformations will be applied in order to the metrics before they are written to the database.
+// The anomaly expressions of the anomaly-expr flag are applied after them.
+// The anomaly start and duration flags can be used to only apply the anomalies to a part of the metrics.
+// The ground truth of the anomalies (which metrics were changed by which anomaly) is written to the injected measurement alongside the metrics.
+// The random draws of the anomalies are made from a source seeded with the seed flag, so a stream can be replayed exactly.
+// The metrics are validated after the anomalies are injected, see validateMetrics.
 func Stream(flags StreamArgs) error {
 	// Initialize the influxdb api
 	var influxDBApi = influxdbapi.NewInfluxDBApi(flags.DBArgs.Token, flags.DBArgs.Host, flags.DBArgs.Port, flags.DBArgs.Org, flags.DBArgs.Bucket, flags.DBArgs.Measurement)
 	defer influxDBApi.Close()
 
-	id := GetIdFromFileName(flags.File)
+	id := flags.Id
+	if id == "" {
+		id = GetIdFromFileName(flags.File)
+	}
 
 	// The time at which the first metric will be inserted defaults to the current time
 	insertTime := time.Now()
@@ -123,35 +244,102 @@ func Stream(flags StreamArgs) error {
 		log.Fatal("Timemultiplier can only be set while appending")
 	}
 
-	// Read and parse the file
-	metrics, err := system_metrics.ReadFromFile(flags.File, id)
-	if err != nil {
-		return err
-	}
-
-	// Modify the metrics slice based on the startat and duration parameters
-	metrics.SliceBetween(flags.StartAt, flags.Duration)
+	// The anomalies need the whole series to be injected, so the file is only read into memory when injecting.
+	// Otherwise the metrics are read from the file one at a time as they are streamed.
+	injecting := len(flags.Anomalies)+len(flags.AnomalyExprs) > 0
+	var all *system_metrics.SystemMetric
+	var metrics system_metrics.MetricIterator
+	if injecting {
+		// Read and parse the file
+		var err error
+		if all, err = system_metrics.ReadFromFile(flags.File, id, flags.Schema); err != nil {
+			return err
+		}
 
-	if len(flags.Anomaly) > 0 {
-		if err := InjectAnomaly(metrics, flags.Anomaly); err != nil {
+		// Modify the metrics slice based on the startat and duration parameters
+		if err := all.SliceBetween(flags.StartAt, flags.Duration); err != nil {
+			return fmt.Errorf("%s: %v", flags.File, err)
+		}
+		metrics = all.Iterator()
+	} else {
+		reader, err := system_metrics.OpenMetricFile(flags.File, flags.Schema)
+		if err != nil {
 			return err
 		}
+		defer reader.Close()
+		metrics = system_metrics.Between(reader, flags.StartAt, flags.Duration)
+	}
+
+	// The first two metrics decide where the metrics are inserted, they are streamed again after peeking at them
+	first, metrics, err := system_metrics.Peek(metrics, 2)
+	if err != nil {
+		return fmt.Errorf("%s: %v", flags.File, err)
+	}
+	if len(first) == 0 {
+		return fmt.Errorf("%s: no metrics after %v", flags.File, flags.StartAt)
 	}
 
 	// If we are appending we need to calculate the time delta between the first two metrics to know where to insert
 	// the first metric.
 	var timeDelta int64 = 0
 	if flags.Append {
-		if len(metrics.Metrics) < 2 {
+		if len(first) < 2 {
 			log.Println("Not enough metrics to calculate time delta, exiting...")
 			return nil
 		}
-		timeDelta = (metrics.Metrics[1].Timestamp - metrics.Metrics[0].Timestamp)
+		timeDelta = (first[1].Timestamp - first[0].Timestamp)
 		insertTime = insertTime.Add(time.Duration(timeDelta) * time.Second)
 	}
 
-	// Insert all metrics except the last one since we need to handle that one separately to avoid an out of bounds error
-	for i, metric := range metrics.Metrics[:len(metrics.Metrics)-1] {
+	// The time the relative timestamps are translated from, it is calculated before injecting the anomalies so their
+	// schedules are resolved against the same times as the metrics are written at
+	// It is also used to write the ground truth labels at the same time as the metrics
+	start := insertTime.Add(-time.Duration(first[0].Timestamp) * time.Second)
+
+	var truths []GroundTruth
+	if injecting {
+		log.Printf("%v: injecting anomalies with seed %v\n", id, flags.Seed)
+		if truths, err = InjectAnomalies(all, flags.Anomalies, flags.AnomalyExprs, flags.AnomalyStart, flags.AnomalyDuration, start, NewRand(flags.Seed, id)); err != nil {
+			return err
+		}
+		if err := validateMetrics(all, truths, flags.Validate); err != nil {
+			return err
+		}
+		// The anomalies may have removed the first metric, every metric is written at start plus its timestamp
+		if len(all.Metrics) > 0 {
+			insertTime = start.Add(time.Duration(all.Metrics[0].Timestamp) * time.Second)
+		}
+		metrics = all.Iterator()
+	}
+
+	// The ground truth labels are written alongside the metrics so they never get ahead of the simulation
+	// labelIndexes contains the index of the first label of each ground truth that has not been written yet
+	labelIndexes := make([]int, len(truths))
+	writeLabelsUntil := func(timestamp int64) error {
+		for i, truth := range truths {
+			end := labelIndexes[i]
+			for end < len(truth.Labels) && truth.Labels[end].Timestamp <= timestamp {
+				end++
+			}
+			if end == labelIndexes[i] {
+				continue
+			}
+			labels := truth
+			labels.Labels = truth.Labels[labelIndexes[i]:end]
+			labelIndexes[i] = end
+			if err := writeGroundTruth(influxDBApi, labels, id, start, flags.Seed); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// The metrics are read one ahead since the time until the next metric decides how long to sleep
+	if !metrics.Next() {
+		return metrics.Err()
+	}
+	metric := metrics.Metric()
+	for {
 		// If the time multiplier is set, we might exceed the current wall time, so we need to check for that, otherwise
 		// we might try to insert metrics with timestamps in the future which will cause an error
 		if insertTime.After(time.Now()) {
@@ -165,9 +353,18 @@ func Stream(flags StreamArgs) error {
 			return err
 		}
 		log.Printf("%v: metric written at %v\n", id, insertTime.Format(time.RFC3339))
+		if err := writeLabelsUntil(metric.Timestamp); err != nil {
+			return err
+		}
+
+		// Stop after the last metric, there is nothing to wait for
+		if !metrics.Next() {
+			break
+		}
+		next := metrics.Metric()
 
 		// Calculate the time delta between the current metric and the next one to get the next insert time
-		timeDelta = (metrics.Metrics[i+1].Timestamp - metric.Timestamp)
+		timeDelta = (next.Timestamp - metric.Timestamp)
 		insertTime = insertTime.Add(time.Duration(timeDelta) * time.Second)
 
 		// Sleep until the next metric should be inserted
@@ -175,14 +372,62 @@ func Stream(flags StreamArgs) error {
 		// FIXME: Using time.Sleep is not very accurate and might cause drift over time, should not be a huge problem though
 		// since the inser time should be completely accurate, but it might be worth looking into a better solution (maybe time.Ticker?)
 		time.Sleep((time.Second * time.Duration(timeDelta)) / time.Duration(flags.TimeMultiplier))
+		metric = next
+	}
+	if err := metrics.Err(); err != nil {
+		return err
 	}
-	// Handle the last metric
-	influxDBApi.WriteMetric(*metrics.Metrics[len(metrics.Metrics)-1], id, insertTime)
-	log.Printf("%v: metric written at %v\n", id, insertTime.Format(time.RFC3339))
 
+	// The labels after the last metric belong to metrics the anomalies removed at the end (e.g. dropout), they are
+	// written like fill writes them
+	return writeLabelsUntil(math.MaxInt64)
+}
+
+// validateMetrics checks the metrics in the windows of the injected anomalies against the invariants of the dataset
+// after the anomalies are injected, the windows are given by their ground truth. Depending on the mode, the violations
+// are logged, returned as an error or clamped, see ValidateMetrics.
+// The ground truth is not changed when metrics are clamped, it only contains what the anomalies changed.
+func validateMetrics(metrics *system_metrics.SystemMetric, truths []GroundTruth, mode ValidationMode) error {
+	violations := ValidateMetrics(metrics, truths, mode == ValidateClamp)
+	if len(violations) == 0 {
+		return nil
+	}
+
+	if mode == ValidateFail {
+		messages := make([]string, len(violations))
+		for i, v := range violations {
+			messages[i] = v.String()
+		}
+		return fmt.Errorf("the injected anomalies made the metrics physically impossible: %s", strings.Join(messages, "; "))
+	}
+	for _, v := range violations {
+		if mode == ValidateClamp {
+			log.Printf("%v: clamped, %v\n", metrics.Id, v)
+		} else {
+			log.Printf("%v: warning, %v\n", metrics.Id, v)
+		}
+	}
 	return nil
 }
 
+// writeGroundTruth writes the labels of an injected anomaly to the injected measurement of the database.
+// The relative timestamps of the labels are translated to absolute timestamps using the start time, the same way
+// as the timestamps of the metrics are translated when they are written.
+// The seed is the seed the anomaly was injected with, it is stored with the labels.
+func writeGroundTruth(api influxdbapi.InfluxDBApi, truth GroundTruth, host string, start time.Time, seed int64) error {
+	// Make sure to set the measurement to injected before writing the labels, api is a copy so this does not affect the caller
+	api.Measurement = "injected"
+
+	// Copy the labels so the relative timestamps of the ground truth are not modified
+	labels := make([]system_metrics.AnomalyDetectionOutput, len(truth.Labels))
+	for i, l := range truth.Labels {
+		l.Timestamp = start.Add(time.Second * time.Duration(l.Timestamp)).Unix()
+		labels[i] = l
+	}
+
+	return api.WriteGroundTruth(labels, host, truth.Anomaly, truth.Spec, seed)
+}
+
 // Clean the database by deleting either all data in the bucket or all data for the specified hosts.
 // The duration flag can be used to specify how far back to delete data.
 // Returns an error if something goes wrong.
@@ -213,3 +458,94 @@ func Clean(flags CleanArgs) error {
 
 	return nil
 }
+
+// anomalyInfo is an anomaly together with its name, used to list the anomalies as JSON
+type anomalyInfo struct {
+	Name string `json:"name"`
+	Anomaly
+}
+
+// ListAnomalies prints the name, description and changed fields of every anomaly in the AnomalyMap, including plugins.
+// The anomalies are printed as a table or as JSON if the json flag is set.
+// Returns an error if the output can not be written.
+func ListAnomalies(flags AnomaliesArgs) error {
+	names := maps.Keys(AnomalyMap)
+	sort.Strings(names)
+
+	if flags.JSON {
+		anomalies := make([]anomalyInfo, len(names))
+		for i, name := range names {
+			anomalies[i] = anomalyInfo{Name: name, Anomaly: AnomalyMap[name]}
+		}
+		return printJSON(anomalies)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tDESCRIPTION\tFIELDS")
+	for _, name := range names {
+		anomaly := AnomalyMap[name]
+		fmt.Fprintf(w, "%s\t%s\t%s\n", name, anomaly.Description, anomalyFields(anomaly))
+	}
+	return w.Flush()
+}
+
+// DescribeAnomaly prints everything that is known about a single anomaly: its description, the fields it changes,
+// its parameters with their defaults and bounds and an example spec.
+// The anomaly is printed as text or as JSON if the json flag is set.
+// Returns an error if the anomaly does not exist or the output can not be written.
+func DescribeAnomaly(flags AnomaliesArgs) error {
+	anomaly, exists := AnomalyMap[flags.Name]
+	if !exists {
+		return fmt.Errorf("anomaly %s does not exist, see 'simba anomalies list'", flags.Name)
+	}
+	if flags.JSON {
+		return printJSON(anomalyInfo{Name: flags.Name, Anomaly: anomaly})
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "%s: %s\n", flags.Name, anomaly.Description)
+	fmt.Fprintf(w, "Fields: %s\n", anomalyFields(anomaly))
+	fmt.Fprintf(w, "Example: %s\n", anomaly.Example)
+	if len(anomaly.Params) > 0 {
+		fmt.Fprintln(w, "\nPARAMETER\tTYPE\tDEFAULT\tMIN\tMAX\tDESCRIPTION")
+		for _, p := range anomaly.Params {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", p.Name, p.Type, orDefault(p.Default, "required"), orDefault(p.Min, "-"), orDefault(p.Max, "-"), p.Description)
+		}
+	}
+	// Every anomaly accepts the window parameters, they are handled by the injection and not by the anomaly itself
+	fmt.Fprintln(w, "\nThe start and duration parameters set the window of the anomaly, see the anomaly-start and anomaly-duration flags.")
+	fmt.Fprintln(w, "The envelope (step, ramp, ease or decay), ramp-in and ramp-out parameters set the strength of the anomaly over its window.")
+	fmt.Fprintln(w, "The schedule parameter, e.g. 'every 24h at 02:00' or a cron expression, repeats the anomaly for its duration.")
+	return w.Flush()
+}
+
+// anomalyFields describes the fields an anomaly changes for the anomalies command
+func anomalyFields(anomaly Anomaly) string {
+	switch {
+	case len(anomaly.Fields) == len(system_metrics.FieldNames()):
+		return "all"
+	case len(anomaly.Fields) > 0:
+		return strings.Join(anomaly.Fields, ", ")
+	case anomaly.OpenParams:
+		return "unknown"
+	}
+	return "the field parameter"
+}
+
+// orDefault returns value, or fallback if value is empty
+func orDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// printJSON prints v as indented JSON to stdout
+func printJSON(v any) error {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Println(string(content))
+	return err
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	system_metrics "internal/system_metrics"
+	"math"
+	"time"
+)
+
+// Real degradations rarely switch on instantly. The envelope of an anomaly sets how strong the anomaly is over its
+// window. The injection blends every transformed value with the original value using the weight of the envelope at
+// the time of the metric, value = original + weight * (transformed - original), so the transformations do not need
+// to know about envelopes. A weight of 1 is the full anomaly and a weight of 0 leaves the metric untouched.
+
+// EnvelopeShape is the shape of the intensity of an anomaly over its window.
+type EnvelopeShape int
+
+const (
+	EnvelopeStep  EnvelopeShape = iota // The anomaly is at full intensity for the whole window
+	EnvelopeRamp                       // The intensity rises linearly over ramp-in and falls linearly over ramp-out
+	EnvelopeEase                       // Like ramp, but the intensity eases in and out along an S-shaped curve
+	EnvelopeDecay                      // The intensity rises linearly over ramp-in and then decays exponentially
+)
+
+// envelopeShapeNames are the names of the envelope shapes as used in the envelope parameter of an anomaly spec
+var envelopeShapeNames = map[EnvelopeShape]string{
+	EnvelopeStep:  "step",
+	EnvelopeRamp:  "ramp",
+	EnvelopeEase:  "ease",
+	EnvelopeDecay: "decay",
+}
+
+// String returns the name of the envelope shape
+func (s EnvelopeShape) String() string {
+	return envelopeShapeNames[s]
+}
+
+// ParseEnvelopeShape returns the envelope shape with the given name.
+// Returns an error if there is no envelope shape with that name.
+func ParseEnvelopeShape(name string) (EnvelopeShape, error) {
+	for shape, shapeName := range envelopeShapeNames {
+		if shapeName == name {
+			return shape, nil
+		}
+	}
+	return 0, fmt.Errorf("must be one of step, ramp, ease or decay")
+}
+
+// Envelope is the intensity of an anomaly over its window. The zero value is a step, the anomaly at full intensity.
+type Envelope struct {
+	Shape   EnvelopeShape // The shape of the envelope
+	RampIn  time.Duration // How long it takes to reach full intensity from the start of the window
+	RampOut time.Duration // How long it takes to fade out before the end of the window, the time constant of decay
+}
+
+// Weight returns the intensity of the anomaly t seconds into a window that is length seconds long, between 0 and 1.
+// The ramps of short windows can overlap, in which case the anomaly never reaches its full intensity.
+// A decay without a ramp-out decays with a time constant of a fifth of the window so it has mostly faded at the end.
+func (e Envelope) Weight(t, length float64) float64 {
+	rampIn, rampOut := e.RampIn.Seconds(), e.RampOut.Seconds()
+
+	switch e.Shape {
+	case EnvelopeRamp:
+		return math.Min(rampWeight(t, rampIn), rampWeight(length-t, rampOut))
+	case EnvelopeEase:
+		return smoothstep(math.Min(rampWeight(t, rampIn), rampWeight(length-t, rampOut)))
+	case EnvelopeDecay:
+		if t < rampIn {
+			return rampWeight(t, rampIn)
+		}
+		if rampOut == 0 {
+			rampOut = length / 5
+		}
+		if rampOut == 0 {
+			return 1
+		}
+		return math.Exp(-(t - rampIn) / rampOut)
+	default:
+		return 1
+	}
+}
+
+// rampWeight returns how far t is into a linear ramp of the given length, between 0 and 1
+func rampWeight(t, length float64) float64 {
+	if length <= 0 {
+		return 1
+	}
+	return math.Max(0, math.Min(t/length, 1))
+}
+
+// smoothstep maps x between 0 and 1 onto an S-shaped curve with a flat start and end
+func smoothstep(x float64) float64 {
+	return x * x * (3 - 2*x)
+}
+
+// apply blends the transformed metrics with the metrics before the transformation using the weight of the envelope.
+// start is the timestamp the window starts at and length is how long the window is in seconds.
+// Metrics removed by the transformation are not brought back, the envelope only applies to the values.
+func (e Envelope) apply(before []system_metrics.Metric, after []*system_metrics.Metric, start int64, length float64) {
+	if e.Shape == EnvelopeStep {
+		return
+	}
+	// The transformations keep the order of the metrics so we only need to go through before once
+	i := 0
+	for _, m := range after {
+		for i < len(before) && before[i].Timestamp != m.Timestamp {
+			i++
+		}
+		if i == len(before) {
+			return
+		}
+		weight := e.Weight(float64(m.Timestamp-start), length)
+		if weight == 1 {
+			i++
+			continue
+		}
+		for _, field := range m.Schema.Names() {
+			original, _ := before[i].Get(field)
+			transformed, _ := m.Get(field)
+			m.Set(field, original+weight*(transformed-original))
+		}
+		i++
+	}
+}
@@ -2,55 +2,1247 @@ package main
 
 import (
 	"fmt"
+	"hash/fnv"
+	"internal/influxdbapi"
 	system_metrics "internal/system_metrics"
 	"math"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// AnomalyMap is a map that maps anomaly names to transformation functions that will be applied to the metrics.
+// Anomaly is a struct containing a transformation function, the parameters it accepts and a description of the anomaly.
+// The parameters are passed to the transformation function with their default values filled in.
+// The description, fields and example are shown by the anomalies command so users can discover the anomalies.
+// Contextual anomalies, whose values are normal overall but wrong for the time they occur, need the metrics around
+// the window. They set ContextTransform instead of Transform.
+type Anomaly struct {
+	Transform        func(m *system_metrics.SystemMetric, p AnomalyParams, rng *rand.Rand) error                                 `json:"-"`           // The transformation applied to the metrics, all random draws must come from rng
+	ContextTransform func(m *system_metrics.SystemMetric, series []system_metrics.Metric, p AnomalyParams, rng *rand.Rand) error `json:"-"`           // Like Transform, but also gets a copy of the whole series as it was before the transformation
+	Params           []AnomalyParam                                                                                              `json:"params"`      // The parameters accepted by the transformation
+	OpenParams       bool                                                                                                        `json:"open-params"` // Whether parameters that are not in Params are accepted, their values are passed on unchecked
+	Description      string                                                                                                      `json:"description"` // What the anomaly does
+	Fields           []string                                                                                                    `json:"fields"`      // The metric fields the anomaly changes, empty if it changes the field given by the field parameter or if they are unknown
+	Example          string                                                                                                      `json:"example"`     // An example anomaly spec
+}
+
+// ParamType is the type of an anomaly parameter, it is used to validate the value of the parameter.
+type ParamType int
+
+const (
+	ParamFloat    ParamType = iota // A floating point number, e.g. 0.5
+	ParamDuration                  // A Go duration string, e.g. 10s, 5m or 1h30m
+	ParamField                     // The name of a metric field, e.g. cpu-user or disk-io-time
+	ParamBool                      // A boolean, e.g. true or false
+)
+
+// paramTypeNames are the names of the parameter types as shown to the user
+var paramTypeNames = map[ParamType]string{
+	ParamFloat:    "float",
+	ParamDuration: "duration",
+	ParamField:    "field",
+	ParamBool:     "bool",
+}
+
+// String returns the name of the parameter type
+func (t ParamType) String() string {
+	return paramTypeNames[t]
+}
+
+// MarshalText makes the parameter type show up by its name in JSON
+func (t ParamType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// AnomalyParam describes a parameter that can be passed to an anomaly in the anomaly spec.
+// The bounds only apply to float and duration parameters, the values must be within them (inclusive).
+type AnomalyParam struct {
+	Name        string    `json:"name"`          // Name of the parameter as used in the anomaly spec
+	Type        ParamType `json:"type"`          // Type of the parameter
+	Default     string    `json:"default"`       // Default value of the parameter, used if the parameter is not set in the spec. Empty if the parameter is required
+	Min         string    `json:"min,omitempty"` // Lowest allowed value of the parameter, empty if there is no lower bound
+	Max         string    `json:"max,omitempty"` // Highest allowed value of the parameter, empty if there is no upper bound
+	Description string    `json:"description"`   // What the parameter does
+}
+
+// AnomalyParams is a map of parameter names to their values as given in the anomaly spec.
+type AnomalyParams map[string]string
+
+// AnomalySpec is a parsed anomaly string such as "sin(field=load-1m,period=1m,magnitude=0.5)".
+// A bare anomaly name such as "cpu-user-high" is also a valid spec, in which case all parameters use their default values.
+// Every anomaly also accepts the start and duration parameters which set the window of the anomaly, these are not passed
+// to the transformation function. If they are not set, the window given to InjectAnomalies is used.
+// The envelope, ramp-in and ramp-out parameters set the Envelope of the anomaly in the same way, see envelope.go.
+// The schedule parameter makes the anomaly recur, it is injected for duration at every time of the Schedule, see schedule.go.
+type AnomalySpec struct {
+	Name     string         // Name of the anomaly, must exist in the AnomalyMap
+	Params   AnomalyParams  // Parameters given in the spec
+	Start    *time.Duration // How far into the metrics the anomaly starts, nil if not set in the spec
+	Duration *time.Duration // How long the anomaly lasts, nil if not set in the spec
+	Envelope Envelope       // The intensity of the anomaly over its window, a step if not set in the spec
+	Schedule Schedule       // The times the anomaly recurs at, nil if not set in the spec
+}
+
+// windowParams are the parameters every anomaly accepts, they are handled by the injection and not by the
+// transformation function
+var windowParams = map[string]bool{
+	"start":    true,
+	"duration": true,
+	"envelope": true,
+	"ramp-in":  true,
+	"ramp-out": true,
+	"schedule": true,
+}
+
+// GroundTruth contains the labels of the metrics that were changed by an injected anomaly.
+// The labels have the same shape as the output of the anomaly detection so they can be compared to each other.
+type GroundTruth struct {
+	Anomaly string                                  // Name of the injected anomaly
+	Spec    string                                  // The anomaly spec the anomaly was injected with
+	Labels  []system_metrics.AnomalyDetectionOutput // One label per metric in the anomaly window, timestamps are relative
+}
+
+// AnomalyMap is a map that maps anomaly names to the anomalies that will be applied to the metrics.
 // The anomaly names are the same as the anomaly flags that can be passed to the fill and stream commands.
-// To add a new anomaly, add a new entry to this map with the anomaly name as the key and the transformation function as the value.
-var AnomalyMap = map[string]func(m *system_metrics.SystemMetric) error{
-	"cpu-user-high": cpuUserHigh,
-	"cpu-user-sin":  cpuUserSin,
+// To add a new anomaly, add a new entry to this map with the anomaly name as the key and an Anomaly containing the
+// transformation function and its parameters as the value.
+// Anomalies implemented as external executables are added to this map by RegisterPlugins, see plugins.go.
+var AnomalyMap = map[string]Anomaly{
+	"constant": {
+		Transform:   constant,
+		Description: "Sets the field to a constant value",
+		Example:     "constant(field=cpu-user,value=0.95)",
+		Params: []AnomalyParam{
+			{Name: "field", Type: ParamField, Description: "The metric to change"},
+			{Name: "value", Type: ParamFloat, Default: "1", Description: "The value to set the field to"},
+			{Name: "probability", Type: ParamFloat, Default: "1", Min: "0", Max: "1", Description: "The probability that a metric is changed"},
+		},
+	},
+	"sin": {
+		Transform:   sine,
+		Description: "Replaces the field with the absolute value of a sine wave",
+		Example:     "sin(field=load-1m,period=5m,magnitude=2)",
+		Params: []AnomalyParam{
+			{Name: "field", Type: ParamField, Description: "The metric to change"},
+			{Name: "magnitude", Type: ParamFloat, Default: "1", Description: "The amplitude of the sine wave"},
+			{Name: "period", Type: ParamDuration, Default: "10s", Description: "The time unit of the sine wave, one radian per period"},
+			{Name: "offset", Type: ParamFloat, Default: "0", Description: "Added to the sine wave"},
+		},
+	},
+	"spike": {
+		Transform:   spike,
+		Description: "Point anomalies, randomly chosen metrics are multiplied by a factor",
+		Example:     "spike(field=cpu-user,factor=3,probability=0.1)",
+		Params: []AnomalyParam{
+			{Name: "field", Type: ParamField, Description: "The metric to change"},
+			{Name: "factor", Type: ParamFloat, Default: "4", Min: "0", Description: "The value is multiplied by factor"},
+			{Name: "probability", Type: ParamFloat, Default: "0.05", Min: "0", Max: "1", Description: "The probability that a metric is a spike"},
+		},
+	},
+	// dip is a spike with a factor lower than 1
+	"dip": {
+		Transform:   spike,
+		Description: "Point anomalies, randomly chosen metrics are multiplied by a factor lower than 1",
+		Example:     "dip(field=disk-io-time,factor=0.1)",
+		Params: []AnomalyParam{
+			{Name: "field", Type: ParamField, Description: "The metric to change"},
+			{Name: "factor", Type: ParamFloat, Default: "0.25", Min: "0", Description: "The value is multiplied by factor"},
+			{Name: "probability", Type: ParamFloat, Default: "0.05", Min: "0", Max: "1", Description: "The probability that a metric is a dip"},
+		},
+	},
+	"level-shift": {
+		Transform:   levelShift,
+		Description: "The field is scaled and shifted for the whole window, starting and ending abruptly",
+		Example:     "level-shift(field=load-5m,factor=1,offset=2)",
+		Params: []AnomalyParam{
+			{Name: "field", Type: ParamField, Description: "The metric to change"},
+			{Name: "factor", Type: ParamFloat, Default: "1.5", Description: "The value is multiplied by factor"},
+			{Name: "offset", Type: ParamFloat, Default: "0", Description: "Added to the value after it is multiplied"},
+		},
+	},
+	"drift": {
+		Transform:   drift,
+		Description: "Linear drift, the field grows by a fixed amount over time",
+		Example:     "drift(field=sys-thermal,rate=2,per=1h)",
+		Params: []AnomalyParam{
+			{Name: "field", Type: ParamField, Description: "The metric to change"},
+			{Name: "rate", Type: ParamFloat, Default: "0.1", Description: "Added to the value for every per since the start of the anomaly"},
+			{Name: "per", Type: ParamDuration, Default: "1h", Description: "The time unit of the rate"},
+		},
+	},
+	"exp-drift": {
+		Transform:   expDrift,
+		Description: "Exponential drift, the field grows by a fixed fraction over time",
+		Example:     "exp-drift(field=disk-io-time,rate=0.5,per=1h)",
+		Params: []AnomalyParam{
+			{Name: "field", Type: ParamField, Description: "The metric to change"},
+			{Name: "rate", Type: ParamFloat, Default: "0.1", Min: "-1", Description: "The value grows by rate (0.1 is 10%) for every per since the start of the anomaly"},
+			{Name: "per", Type: ParamDuration, Default: "1h", Description: "The time unit of the rate"},
+		},
+	},
+	"noise-burst": {
+		Transform:   noiseBurst,
+		Description: "Variance burst, gaussian noise is added to the field",
+		Example:     "noise-burst(field=sys-interrupt-rate,factor=5)",
+		Params: []AnomalyParam{
+			{Name: "field", Type: ParamField, Description: "The metric to change"},
+			{Name: "factor", Type: ParamFloat, Default: "3", Min: "0", Description: "The standard deviation of the noise in standard deviations of the field"},
+		},
+	},
+	"flatline": {
+		Transform:   flatline,
+		Description: "Stuck sensor, the field keeps the value it had at the start of the anomaly",
+		Example:     "flatline(field=sys-thermal)",
+		Params: []AnomalyParam{
+			{Name: "field", Type: ParamField, Description: "The metric to change"},
+		},
+	},
+	"dropout": {
+		Transform:   dropout,
+		Description: "Missing data, metrics are removed",
+		Fields:      system_metrics.FieldNames(),
+		Example:     "dropout(probability=0.5)",
+		Params: []AnomalyParam{
+			{Name: "probability", Type: ParamFloat, Default: "1", Min: "0", Max: "1", Description: "The probability that a metric is removed"},
+		},
+	},
+	"memory-leak": {
+		Transform:   memoryLeak,
+		Description: "A process leaks memory, taken from free memory, then cache and buffers and finally swap",
+		Fields:      []string{"sys-mem-free", "sys-mem-available", "sys-mem-cache", "sys-mem-buffered", "sys-mem-swap-free"},
+		Example:     "memory-leak(rate=0.1,per=1h)",
+		Params: []AnomalyParam{
+			{Name: "rate", Type: ParamFloat, Default: "0.05", Min: "0", Description: "The fraction of the total memory leaked every per"},
+			{Name: "per", Type: ParamDuration, Default: "1h", Description: "The time unit of the rate"},
+			{Name: "min-free", Type: ParamFloat, Default: "0.02", Min: "0", Max: "1", Description: "The fraction of the total memory that is kept free, below it only cache, buffers and swap are used"},
+			{Name: "pressure", Type: ParamFloat, Default: "0.2", Min: "0", Max: "1", Description: "The fraction of the total memory free below which cache and buffers are reclaimed, more and more as free memory approaches min-free"},
+		},
+	},
+	"reboot": {
+		Transform:   reboot,
+		Description: "The server crashes and reboots, load averages catch up and cache and buffers grow back afterwards",
+		Fields: []string{"server-up", "load-1m", "load-5m", "load-15m", "sys-mem-free", "sys-mem-cache", "sys-mem-buffered", "sys-mem-swap-free",
+			"sys-fork-rate", "sys-interrupt-rate", "sys-context-switch-rate", "disk-io-time", "disk-bytes-read", "disk-bytes-written",
+			"disk-io-read", "disk-io-write", "cpu-iowait", "cpu-system", "cpu-user"},
+		Example: "reboot(down=15m,drop=true)",
+		Params: []AnomalyParam{
+			{Name: "down", Type: ParamDuration, Default: "10m", Description: "How long the server is down at the start of the anomaly"},
+			{Name: "drop", Type: ParamBool, Default: "false", Description: "Whether to remove the metrics of the outage except the first one"},
+			{Name: "recovery", Type: ParamDuration, Default: "30m", Description: "The time constant of the cache and buffers growing back"},
+		},
+	},
+	"io-saturation": {
+		Transform:   ioSaturation,
+		Description: "The disk is saturated, I/O and iowait go up and blocked processes raise the load",
+		Fields: []string{"disk-io-time", "disk-bytes-read", "disk-bytes-written", "disk-io-read", "disk-io-write", "cpu-iowait", "cpu-system",
+			"cpu-user", "load-1m", "load-5m", "load-15m"},
+		Example: "io-saturation(factor=8,iowait=0.8)",
+		Params: []AnomalyParam{
+			{Name: "factor", Type: ParamFloat, Default: "5", Min: "0", Description: "The disk I/O time, operations and bytes are multiplied by factor"},
+			{Name: "iowait", Type: ParamFloat, Default: "0.6", Min: "0", Max: "1", Description: "The lowest fraction of CPU time spent waiting for I/O"},
+			{Name: "load", Type: ParamFloat, Default: "4", Min: "0", Description: "The number of blocked processes added to the load"},
+		},
+	},
+	"fork-bomb": {
+		Transform:   forkBomb,
+		Description: "A fork bomb, forks and context switches spike, system CPU saturates and the load climbs",
+		Fields:      []string{"sys-fork-rate", "sys-context-switch-rate", "cpu-iowait", "cpu-system", "cpu-user", "load-1m", "load-5m", "load-15m"},
+		Example:     "fork-bomb(growth=30,limit=300)",
+		Params: []AnomalyParam{
+			{Name: "factor", Type: ParamFloat, Default: "20", Min: "0", Description: "The fork and context switch rates are multiplied by factor"},
+			{Name: "system", Type: ParamFloat, Default: "0.85", Min: "0", Max: "1", Description: "The lowest fraction of CPU time spent in the kernel"},
+			{Name: "growth", Type: ParamFloat, Default: "10", Min: "0", Description: "The number of processes added to the load every minute"},
+			{Name: "limit", Type: ParamFloat, Default: "100", Min: "0", Description: "The highest number of processes added to the load"},
+		},
+	},
+	"thermal-runaway": {
+		Transform:   thermalRunaway,
+		Description: "The temperature rises until the CPU is throttled, capping CPU time and raising the load",
+		Fields:      []string{"sys-thermal", "cpu-system", "cpu-user", "load-1m", "load-5m", "load-15m"},
+		Example:     "thermal-runaway(rate=1,throttle=15)",
+		Params: []AnomalyParam{
+			{Name: "rate", Type: ParamFloat, Default: "0.5", Min: "0", Description: "How many degrees the temperature rises every minute"},
+			{Name: "throttle", Type: ParamFloat, Default: "20", Min: "0", Description: "How many degrees the temperature rises before the CPU is throttled"},
+			{Name: "cap", Type: ParamFloat, Default: "0.5", Min: "0", Max: "1", Description: "The highest fraction of CPU time for user and system when throttled"},
+			{Name: "load", Type: ParamFloat, Default: "2", Min: "0", Description: "The number of waiting processes added to the load when throttled"},
+		},
+	},
+	// cpu-user-high and cpu-user-sin are kept for backwards compatibility, they are the same as constant and sin on cpu-user
+	"cpu-user-high": {
+		Transform:   constant,
+		Description: "The same as constant but the field defaults to cpu-user",
+		Example:     "cpu-user-high",
+		Params: []AnomalyParam{
+			{Name: "field", Type: ParamField, Default: "cpu-user", Description: "The metric to change"},
+			{Name: "value", Type: ParamFloat, Default: "1", Description: "The value to set the field to"},
+			{Name: "probability", Type: ParamFloat, Default: "1", Min: "0", Max: "1", Description: "The probability that a metric is changed"},
+		},
+	},
+	"cpu-user-sin": {
+		Transform:   sine,
+		Description: "The same as sin but the field defaults to cpu-user",
+		Example:     "cpu-user-sin(period=5m,magnitude=0.5,offset=0.2)",
+		Params: []AnomalyParam{
+			{Name: "field", Type: ParamField, Default: "cpu-user", Description: "The metric to change"},
+			{Name: "magnitude", Type: ParamFloat, Default: "1", Description: "The amplitude of the sine wave"},
+			{Name: "period", Type: ParamDuration, Default: "10s", Description: "The time unit of the sine wave, one radian per period"},
+			{Name: "offset", Type: ParamFloat, Default: "0", Description: "Added to the sine wave"},
+		},
+	},
+	"time-shift": {
+		ContextTransform: timeShift,
+		Description:      "Contextual, the metrics are replaced by the metrics from shift earlier, e.g. a daytime profile at night",
+		Fields:           system_metrics.FieldNames(),
+		Example:          "time-shift(shift=12h,start=14h,duration=6h)",
+		Params: []AnomalyParam{
+			{Name: "shift", Type: ParamDuration, Default: "12h", Description: "How far from the window the replayed metrics are taken"},
+			{Name: "ahead", Type: ParamBool, Default: "false", Description: "Take the metrics from shift later instead of earlier"},
+		},
+	},
+	"swap": {
+		Transform:   swap,
+		Description: "Contextual, the parts of the window before and after split swap places, e.g. day and night",
+		Fields:      system_metrics.FieldNames(),
+		Example:     "swap(split=0.5,duration=1d)",
+		Params: []AnomalyParam{
+			{Name: "split", Type: ParamFloat, Default: "0.5", Min: "0", Max: "1", Description: "Where the window is split, as a fraction of its length"},
+		},
+	},
+}
+
+// specRegex matches an anomaly spec and captures the name and the (optional) parameter list in different groups
+var specRegex = regexp.MustCompile(`^([a-z0-9-]+)(?:\((.*)\))?$`)
+
+// ParseAnomalySpec parses an anomaly string on the form name(key=value,key=value) into an AnomalySpec.
+// Values containing commas must be quoted, e.g. schedule='0 2,14 * * *', see splitParams.
+// The parameters are validated against the parameters of the anomaly in the AnomalyMap.
+// Returns an error if the string is malformed, the anomaly does not exist or a parameter is unknown or invalid.
+func ParseAnomalySpec(anomalyString string) (*AnomalySpec, error) {
+	match := specRegex.FindStringSubmatch(strings.TrimSpace(anomalyString))
+	if len(match) == 0 {
+		return nil, fmt.Errorf("invalid anomaly spec: %s", anomalyString)
+	}
+
+	spec := AnomalySpec{Name: match[1], Params: AnomalyParams{}}
+	anomaly, exists := AnomalyMap[spec.Name]
+	if !exists {
+		return nil, fmt.Errorf("error injection %s is not implemented", spec.Name)
+	}
+
+	// Split the parameter list into key value pairs
+	window := map[string]string{}
+	pairs, err := splitParams(match[2])
+	if err != nil {
+		return nil, fmt.Errorf("%v in anomaly spec: %s", err, anomalyString)
+	}
+	for _, pair := range pairs {
+		key, value, found := strings.Cut(pair, "=")
+		key, value = strings.TrimSpace(key), unquote(strings.TrimSpace(value))
+		if !found || key == "" || value == "" {
+			return nil, fmt.Errorf("invalid parameter '%s' in anomaly spec: %s", pair, anomalyString)
+		}
+		_, duplicate := spec.Params[key]
+		_, duplicateWindow := window[key]
+		if duplicate || duplicateWindow {
+			return nil, fmt.Errorf("parameter %s is set more than once in anomaly spec: %s", key, anomalyString)
+		}
+		// The window parameters are handled by InjectAnomalies and not by the transformation function
+		if windowParams[key] {
+			window[key] = value
+			continue
+		}
+		spec.Params[key] = value
+	}
+	if err := spec.parseWindow(window); err != nil {
+		return nil, fmt.Errorf("%s: %v", spec.Name, err)
+	}
+
+	if err := anomaly.validate(spec.Params); err != nil {
+		return nil, fmt.Errorf("%s: %v", spec.Name, err)
+	}
+
+	return &spec, nil
+}
+
+// splitParams splits the parameter list of an anomaly spec at the commas between the parameters.
+// Commas inside quotes ('...' or "...") or brackets ((), [] or {}) belong to the value, so values such as the lists of a
+// cron expression can contain commas when they are quoted, e.g. schedule='0 2,14 * * *'.
+// Returns an error if a quote is not closed or the brackets do not match.
+func splitParams(list string) ([]string, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	pairs := []string{}
+	closing := map[rune]rune{'(': ')', '[': ']', '{': '}'}
+	brackets := []rune{} // The closing brackets of the open brackets, innermost last
+	var quote rune
+	start := 0
+	for i, r := range list {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case closing[r] != 0:
+			brackets = append(brackets, closing[r])
+		case r == ')' || r == ']' || r == '}':
+			if len(brackets) == 0 || brackets[len(brackets)-1] != r {
+				return nil, fmt.Errorf("unexpected '%c'", r)
+			}
+			brackets = brackets[:len(brackets)-1]
+		case r == ',' && len(brackets) == 0:
+			pairs = append(pairs, list[start:i])
+			start = i + 1
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c", quote)
+	}
+	if len(brackets) > 0 {
+		return nil, fmt.Errorf("missing '%c'", brackets[len(brackets)-1])
+	}
+	return append(pairs, list[start:]), nil
+}
+
+// unquote removes the quotes around a quoted parameter value, other values are returned as they are
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '\'' || value[0] == '"') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// parseWindow sets the window and envelope of the spec from the window parameters of the anomaly spec
+func (spec *AnomalySpec) parseWindow(window map[string]string) error {
+	durations := map[string]*time.Duration{}
+	for _, key := range []string{"start", "duration", "ramp-in", "ramp-out"} {
+		value, exists := window[key]
+		if !exists {
+			continue
+		}
+		d, err := parseWindowDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid value '%s' for parameter %s: %v", value, key, err)
+		}
+		durations[key] = &d
+	}
+	spec.Start, spec.Duration = durations["start"], durations["duration"]
+
+	if value, exists := window["envelope"]; exists {
+		shape, err := ParseEnvelopeShape(value)
+		if err != nil {
+			return fmt.Errorf("invalid value '%s' for parameter envelope: %v", value, err)
+		}
+		spec.Envelope.Shape = shape
+	}
+	if durations["ramp-in"] != nil {
+		spec.Envelope.RampIn = *durations["ramp-in"]
+	}
+	if durations["ramp-out"] != nil {
+		spec.Envelope.RampOut = *durations["ramp-out"]
+	}
+	if spec.Envelope.Shape == EnvelopeStep && (spec.Envelope.RampIn != 0 || spec.Envelope.RampOut != 0) {
+		return fmt.Errorf("ramp-in and ramp-out require an envelope other than step")
+	}
+
+	if value, exists := window["schedule"]; exists {
+		schedule, err := ParseSchedule(value)
+		if err != nil {
+			return err
+		}
+		// Every occurrence starts at its time in the schedule and needs an end so the occurrences do not run together
+		if spec.Start != nil || spec.Duration == nil || *spec.Duration == 0 {
+			return fmt.Errorf("schedule requires a duration and can not be combined with start")
+		}
+		spec.Schedule = schedule
+	}
+	return nil
 }
 
-// InjectAnomaly injects an anomaly into the metrics based on the anomalyFlag.
-// If the anomalyFlag is empty, no anomaly will be injected.
-// If the anomalyFlag is not empty, but does not exist in the AnomalyMap, an error will be returned.
-// If the anomalyFlag exists in the AnomalyMap, the transformation function will be called with the metrics as the argument.
+// parseWindowDuration parses the start and duration parameters of an anomaly spec and the values of its duration
+// parameters. Both the duration strings of the command line flags (e.g. 1d) and Go duration strings (e.g. 1h30m) are
+// accepted.
+func parseWindowDuration(value string) (time.Duration, error) {
+	if d, err := influxdbapi.ParseDurationString(value); err == nil {
+		return d, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("must not be negative")
+	}
+	return d, nil
+}
+
+// validate checks that every parameter in params is accepted by the anomaly and has a valid value
+// It also checks that all required parameters are set
+func (a Anomaly) validate(params AnomalyParams) error {
+	for _, p := range a.Params {
+		if _, exists := params[p.Name]; !exists && p.Default == "" {
+			return fmt.Errorf("missing required parameter %s", p.Name)
+		}
+	}
+	for key, value := range params {
+		param, exists := a.param(key)
+		if !exists && a.OpenParams {
+			continue
+		}
+		if !exists {
+			return fmt.Errorf("unknown parameter %s", key)
+		}
+		if err := param.check(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// param returns the parameter with the given name
+func (a Anomaly) param(name string) (AnomalyParam, bool) {
+	for _, p := range a.Params {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return AnomalyParam{}, false
+}
+
+// withDefaults returns a copy of params where all parameters that are not set use their default values
+func (a Anomaly) withDefaults(params AnomalyParams) AnomalyParams {
+	complete := AnomalyParams{}
+	for _, p := range a.Params {
+		complete[p.Name] = p.Default
+	}
+	for key, value := range params {
+		complete[key] = value
+	}
+	return complete
+}
+
+// check returns an error if value is not a valid value for the parameter
+func (p AnomalyParam) check(value string) error {
+	var err error
+	switch p.Type {
+	case ParamFloat:
+		_, err = strconv.ParseFloat(value, 64)
+	case ParamDuration:
+		var d time.Duration
+		if d, err = parseWindowDuration(value); err == nil && d <= 0 {
+			err = fmt.Errorf("must be positive")
+		}
+	case ParamBool:
+		_, err = strconv.ParseBool(value)
+	case ParamField:
+		// The fields depend on the schema of the metrics, so whether the field exists is checked when it is injected
+		if value == "timestamp" {
+			err = fmt.Errorf("must be a metric field, the timestamp can not be changed")
+		}
+	}
+	if err == nil {
+		err = p.checkBounds(value)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value '%s' for parameter %s: %v", value, p.Name, err)
+	}
+	return nil
+}
+
+// checkBounds returns an error if a float or duration value is outside the bounds of the parameter
+// The value must already be valid for the type of the parameter
+func (p AnomalyParam) checkBounds(value string) error {
+	// Durations are compared in seconds
+	var number float64
+	switch p.Type {
+	case ParamFloat:
+		number, _ = strconv.ParseFloat(value, 64)
+	case ParamDuration:
+		d, _ := parseWindowDuration(value)
+		number = d.Seconds()
+	default:
+		return nil
+	}
+	bound := func(b string) float64 {
+		if p.Type == ParamDuration {
+			d, _ := parseWindowDuration(b)
+			return d.Seconds()
+		}
+		f, _ := strconv.ParseFloat(b, 64)
+		return f
+	}
+	if p.Min != "" && number < bound(p.Min) {
+		return fmt.Errorf("must be at least %s", p.Min)
+	}
+	if p.Max != "" && number > bound(p.Max) {
+		return fmt.Errorf("must be at most %s", p.Max)
+	}
+	return nil
+}
+
+// Float returns the value of the parameter as a float64.
+// The parameters are validated before they are passed to the transformation functions, so this does not return an error.
+func (p AnomalyParams) Float(name string) float64 {
+	value, _ := strconv.ParseFloat(p[name], 64)
+	return value
+}
+
+// Bool returns the value of the parameter as a bool.
+// The parameters are validated before they are passed to the transformation functions, so this does not return an error.
+func (p AnomalyParams) Bool(name string) bool {
+	value, _ := strconv.ParseBool(p[name])
+	return value
+}
+
+// Duration returns the value of the parameter as a time.Duration.
+// The parameters are validated before they are passed to the transformation functions, so this does not return an error.
+func (p AnomalyParams) Duration(name string) time.Duration {
+	value, _ := parseWindowDuration(p[name])
+	return value
+}
+
+// NewRand returns the random source used to inject anomalies into the metrics of the system with the given id.
+// The source is derived from both the seed and the id so that systems simulated in parallel with the same seed
+// do not share a source but every system still gets the same random draws every time the seed is used.
+func NewRand(seed int64, id string) *rand.Rand {
+	hash := fnv.New64a()
+	hash.Write([]byte(id))
+	return rand.New(rand.NewSource(seed ^ int64(hash.Sum64())))
+}
+
+// NewSeed returns a seed based on the current time, used when no seed is given.
+func NewSeed() int64 {
+	return time.Now().UnixNano()
+}
+
+// InjectAnomalies injects several anomalies into the metrics, see injectAnomaly for how a single anomaly is injected.
+// The anomalies are applied in order as a pipeline, each anomaly is applied to the output of the previous one.
+// The start and duration parameters are the default window for the anomalies that do not set their own window.
+// The anomaly expressions (see ParseExpression) are applied after the anomalies in the same window, in the order they are given.
+// The base is the absolute time the relative timestamps of the metrics are translated from when they are written (see
+// influxdbapi.StartTime), the schedules of the anomalies are resolved against it.
+// All random draws of the anomalies come from rng so the same source seeded the same way gives the same result, see NewRand.
+// Returns the GroundTruth of every anomaly in the same order as the anomalyFlags, followed by those of the expressions.
+// A scheduled anomaly has one GroundTruth per occurrence.
+func InjectAnomalies(metrics *system_metrics.SystemMetric, anomalyFlags, expressions []string, start, duration time.Duration, base time.Time, rng *rand.Rand) ([]GroundTruth, error) {
+	if len(metrics.Metrics) == 0 {
+		return nil, fmt.Errorf("no metrics to inject anomalies into")
+	}
+
+	// The windows of all anomalies are relative to the first metric before any anomaly is injected
+	// Otherwise an anomaly that removes the first metric would move the windows of the following anomalies
+	origin := metrics.Metrics[0].Timestamp
+
+	truths := []GroundTruth{}
+	for _, anomalyFlag := range anomalyFlags {
+		anomalyTruths, err := injectAnomaly(metrics, anomalyFlag, origin, start, duration, base, rng)
+		if err != nil {
+			return nil, err
+		}
+		truths = append(truths, anomalyTruths...)
+	}
+	for _, source := range expressions {
+		expression, err := ParseExpression(source)
+		if err != nil {
+			return nil, err
+		}
+		truth, err := injectWindow(metrics, expression.Anomaly(), AnomalyParams{}, "expr", expression.String(), origin, start, duration, Envelope{}, rng)
+		if err != nil {
+			return nil, err
+		}
+		truths = append(truths, *truth)
+	}
+	return truths, nil
+}
+
+// injectAnomaly injects an anomaly into the metrics based on the anomalyFlag.
+// The anomalyFlag is an anomaly spec, see ParseAnomalySpec for the format.
+// If the anomalyFlag is empty, no anomaly will be injected and no GroundTruth is returned.
+// If the anomalyFlag is not empty, but is not a valid anomaly spec, an error will be returned.
+// If the anomalyFlag is valid, the transformation function will be called with the metrics and parameters as the arguments.
+// The start and duration parameters limit the anomaly to a window of the metrics, start is relative to the origin
+// timestamp, the timestamp of the first metric before any anomaly was injected.
+// If duration is 0, the anomaly will last until the end of the metrics. If both are 0, all metrics will be transformed.
+// The start and duration parameters of the anomaly spec take precedence over the start and duration arguments.
+// If the anomaly spec has a schedule, the anomaly is injected at every time of the schedule within the metrics instead,
+// resolved against the absolute times of the metrics starting at base.
+// Returns the GroundTruth of the anomaly, marking which fields of which metrics were changed by the transformation.
+// A scheduled anomaly returns one GroundTruth per occurrence.
+// The random draws of the anomaly come from rng.
 // Any errors that the transformation function returns will be returned.
-func InjectAnomaly(metrics *system_metrics.SystemMetric, anomalyFlag string) error {
+func injectAnomaly(metrics *system_metrics.SystemMetric, anomalyFlag string, origin int64, start, duration time.Duration, base time.Time, rng *rand.Rand) ([]GroundTruth, error) {
 	if anomalyFlag == "" {
-		return nil
+		return nil, nil
+	}
+
+	// Parse the anomalyFlag and check that the anomaly exists in the AnomalyMap
+	spec, err := ParseAnomalySpec(anomalyFlag)
+	if err != nil {
+		return nil, err
+	}
+	anomaly := AnomalyMap[spec.Name]
+	if spec.Schedule != nil {
+		return injectSchedule(metrics, anomaly, spec, strings.TrimSpace(anomalyFlag), origin, base, rng)
+	}
+	if spec.Start != nil {
+		start = *spec.Start
+	}
+	if spec.Duration != nil {
+		duration = *spec.Duration
+	}
+
+	truth, err := injectWindow(metrics, anomaly, anomaly.withDefaults(spec.Params), spec.Name, strings.TrimSpace(anomalyFlag), origin, start, duration, spec.Envelope, rng)
+	if err != nil {
+		return nil, err
+	}
+	return []GroundTruth{*truth}, nil
+}
+
+// injectSchedule injects the anomaly for the duration of the spec at every time of its schedule that overlaps the metrics.
+// The absolute time of a metric is base plus its timestamp, the same as when it is written.
+// Occurrences that fall in a gap of the metrics are skipped, but the schedule must occur at least once.
+func injectSchedule(metrics *system_metrics.SystemMetric, anomaly Anomaly, spec *AnomalySpec, anomalyFlag string, origin int64, base time.Time, rng *rand.Rand) ([]GroundTruth, error) {
+	duration := *spec.Duration
+	first := base.Add(time.Duration(origin) * time.Second)
+	last := base.Add(time.Duration(metrics.Metrics[len(metrics.Metrics)-1].Timestamp) * time.Second)
+
+	truths := []GroundTruth{}
+	for _, occurrence := range Occurrences(spec.Schedule, first.Add(-duration), last) {
+		// The window starts at the first whole second at or after the occurrence
+		from := int64(math.Ceil(occurrence.Sub(base).Seconds()))
+		if startIndex, endIndex := metrics.TimestampBounds(from, from+int64(duration.Seconds())); startIndex == endIndex {
+			continue
+		}
+		start := time.Duration(from-origin) * time.Second
+		truth, err := injectWindow(metrics, anomaly, anomaly.withDefaults(spec.Params), spec.Name, anomalyFlag, origin, start, duration, spec.Envelope, rng)
+		if err != nil {
+			return nil, err
+		}
+		truths = append(truths, *truth)
+	}
+	if len(truths) == 0 {
+		return nil, fmt.Errorf("the schedule of anomaly %s does not occur within the simulated metrics", anomalyFlag)
+	}
+	return truths, nil
+}
+
+// injectWindow applies the transformation of the anomaly with the given parameters to the window of the metrics
+// starting start after the origin timestamp and lasting duration (until the end of the metrics if 0).
+// The transformed metrics are blended with the original metrics using the envelope.
+// The name and spec are only used to label the returned GroundTruth.
+func injectWindow(metrics *system_metrics.SystemMetric, anomaly Anomaly, params AnomalyParams, name, spec string, origin int64, start, duration time.Duration, envelope Envelope, rng *rand.Rand) (*GroundTruth, error) {
+	// Only the metrics inside the window are passed to the transformation function
+	// The window shares the metrics with the original slice so the transformation is applied in place
+	windowEnd := int64(math.MaxInt64)
+	if duration != 0 {
+		windowEnd = origin + int64(start.Seconds()+duration.Seconds())
+	}
+	startIndex, endIndex := metrics.TimestampBounds(origin+int64(start.Seconds()), windowEnd)
+	window := system_metrics.SystemMetric{Id: metrics.Id, Metrics: metrics.Metrics[startIndex:endIndex]}
+	if len(window.Metrics) == 0 {
+		return nil, fmt.Errorf("anomaly window starting at %v is outside of the simulated metrics", start)
+	}
+
+	// Keep a copy of the metrics in the window so we can find out what the transformation changed
+	before := make([]system_metrics.Metric, len(window.Metrics))
+	for i, m := range window.Metrics {
+		before[i] = m.Copy()
+	}
+
+	// Call the transformation function of the anomaly
+	// Contextual anomalies also get a copy of the whole series so they can read the metrics they replay from outside
+	// the window without seeing what the transformation has already changed
+	if anomaly.ContextTransform != nil {
+		series := make([]system_metrics.Metric, len(metrics.Metrics))
+		for i, m := range metrics.Metrics {
+			series[i] = m.Copy()
+		}
+		if err := anomaly.ContextTransform(&window, series, params, rng); err != nil {
+			return nil, err
+		}
+	} else if err := anomaly.Transform(&window, params, rng); err != nil {
+		return nil, err
+	}
+
+	// The envelope is applied over the whole window, which lasts until the last metric if it has no duration
+	windowStart := origin + int64(start.Seconds())
+	length := duration.Seconds()
+	if duration == 0 {
+		length = float64(before[len(before)-1].Timestamp - windowStart)
+	}
+	envelope.apply(before, window.Metrics, windowStart, length)
+
+	// If the transformation removed metrics from the window, the window no longer matches the original slice
+	// The metrics around the window are joined with the new window in a new slice
+	if len(window.Metrics) != endIndex-startIndex {
+		joined := append([]*system_metrics.Metric{}, metrics.Metrics[:startIndex]...)
+		joined = append(joined, window.Metrics...)
+		metrics.Metrics = append(joined, metrics.Metrics[endIndex:]...)
+		if len(metrics.Metrics) == 0 {
+			return nil, fmt.Errorf("anomaly %s removed all metrics", name)
+		}
+	}
+
+	return &GroundTruth{Anomaly: name, Spec: spec, Labels: labelChanges(before, window.Metrics)}, nil
+}
+
+// labelChanges compares the metrics before and after a transformation and returns a label for every metric.
+// A field of the label is true if the transformation changed the value of that field.
+// If the transformation removed a metric, every field of its label is true since the whole metric is missing.
+func labelChanges(before []system_metrics.Metric, after []*system_metrics.Metric) []system_metrics.AnomalyDetectionOutput {
+	labels := make([]system_metrics.AnomalyDetectionOutput, len(before))
+	// j is the index of the metric in after that matches the metric in before
+	// The transformations keep the order of the metrics so we only need to go through after once
+	j := 0
+	for i := range before {
+		labels[i].Timestamp = before[i].Timestamp
+		removed := j >= len(after) || after[j].Timestamp != before[i].Timestamp
+		for _, field := range before[i].Schema.Names() {
+			if removed {
+				labels[i].Set(field, true)
+				continue
+			}
+			oldValue, _ := before[i].Get(field)
+			newValue, _ := after[j].Get(field)
+			labels[i].Set(field, oldValue != newValue)
+		}
+		if !removed {
+			j++
+		}
+	}
+	return labels
+}
+
+// transformField replaces the value of field for every metric with the value returned by f.
+// f is called with the index of the metric in the window, the metric and the current value of the field.
+// This is a helper for the anomalies that only change a single field.
+func transformField(metrics *system_metrics.SystemMetric, field string, f func(i int, m *system_metrics.Metric, value float64) float64) error {
+	for i, m := range metrics.Metrics {
+		value, err := m.Get(field)
+		if err != nil {
+			return err
+		}
+		if err := m.Set(field, f(i, m, value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requireFields returns an error if the metrics do not have all the given fields.
+// This is a helper for the anomalies that change fields of the dataset provided by Westermo, they can not be injected
+// into metrics with another schema that lacks those fields.
+func requireFields(metrics *system_metrics.SystemMetric, fields ...string) error {
+	schema := metrics.Schema()
+	for _, field := range fields {
+		if !schema.Has(field) {
+			return fmt.Errorf("the metrics do not have the field %s", field)
+		}
+	}
+	return nil
+}
+
+// addLoad adds extra processes to the load averages of the metrics.
+// excess returns the number of extra runnable or blocked processes t seconds into the window.
+// The load averages are exponential moving averages of the number of processes with 1, 5 and 15 minute time constants,
+// so the extra load is averaged the same way to get the natural lag of the load averages.
+// The load fields must exist, see requireFields.
+func addLoad(metrics *system_metrics.SystemMetric, excess func(t float64) float64) {
+	var load1m, load5m, load15m, previous float64
+	for _, m := range metrics.Metrics {
+		t := elapsed(metrics, m)
+		x := excess(t)
+		load1m = x + (load1m-x)*math.Exp(-(t-previous)/60)
+		load5m = x + (load5m-x)*math.Exp(-(t-previous)/300)
+		load15m = x + (load15m-x)*math.Exp(-(t-previous)/900)
+		previous = t
+
+		m.Values["load-1m"] += load1m
+		m.Values["load-5m"] += load5m
+		m.Values["load-15m"] += load15m
+	}
+}
+
+// elapsed returns the number of seconds between the first metric of the window and m
+func elapsed(metrics *system_metrics.SystemMetric, m *system_metrics.Metric) float64 {
+	return float64(m.Timestamp - metrics.Metrics[0].Timestamp)
+}
+
+// Basic example anomaly. Sets field to value for the metrics, each metric is changed with the given probability
+func constant(metrics *system_metrics.SystemMetric, p AnomalyParams, rng *rand.Rand) error {
+	for _, m := range metrics.Metrics {
+		if rng.Float64() < p.Float("probability") {
+			if err := m.Set(p["field"], p.Float("value")); err != nil {
+				return err
+			}
+		}
 	}
 
-	// Check if the anomalyFlag string exists in the AnomalyMap
-	if _, ok := AnomalyMap[anomalyFlag]; !ok {
-		return fmt.Errorf("anomaly flag %s does not exist", anomalyFlag)
+	return nil
+}
+
+// Changes field to a timestamp based sin function (absolut value of sin)
+// The sin function is scaled by magnitude and shifted by offset, period is the time unit of the timestamp
+func sine(metrics *system_metrics.SystemMetric, p AnomalyParams, _ *rand.Rand) error {
+	period := p.Duration("period").Seconds()
+	for _, m := range metrics.Metrics {
+		if err := m.Set(p["field"], p.Float("offset")+p.Float("magnitude")*math.Abs(math.Sin(float64(m.Timestamp)/period))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Point anomaly. Multiplies field by factor for randomly chosen metrics, each metric is changed with the given probability
+// A factor larger than 1 gives spikes and a factor between 0 and 1 gives dips
+func spike(metrics *system_metrics.SystemMetric, p AnomalyParams, rng *rand.Rand) error {
+	return transformField(metrics, p["field"], func(_ int, _ *system_metrics.Metric, value float64) float64 {
+		if rng.Float64() < p.Float("probability") {
+			return value * p.Float("factor")
+		}
+		return value
+	})
+}
+
+// Level shift. Multiplies field by factor and adds offset for all metrics, the shift starts and ends abruptly
+func levelShift(metrics *system_metrics.SystemMetric, p AnomalyParams, _ *rand.Rand) error {
+	return transformField(metrics, p["field"], func(_ int, _ *system_metrics.Metric, value float64) float64 {
+		return value*p.Float("factor") + p.Float("offset")
+	})
+}
+
+// Linear drift. Adds rate to field for every per duration that has passed since the start of the window
+func drift(metrics *system_metrics.SystemMetric, p AnomalyParams, _ *rand.Rand) error {
+	per := p.Duration("per").Seconds()
+	return transformField(metrics, p["field"], func(_ int, m *system_metrics.Metric, value float64) float64 {
+		return value + p.Float("rate")*elapsed(metrics, m)/per
+	})
+}
+
+// Exponential drift. Field grows by rate (e.g. 0.1 is 10%) for every per duration that has passed since the start of the window
+func expDrift(metrics *system_metrics.SystemMetric, p AnomalyParams, _ *rand.Rand) error {
+	per := p.Duration("per").Seconds()
+	return transformField(metrics, p["field"], func(_ int, m *system_metrics.Metric, value float64) float64 {
+		return value * math.Pow(1+p.Float("rate"), elapsed(metrics, m)/per)
+	})
+}
+
+// Variance burst. Adds gaussian noise to field with a standard deviation of factor times the standard deviation of
+// the field in the window. If the field is constant in the window, a tenth of its mean is used instead (or 1 if it is 0)
+func noiseBurst(metrics *system_metrics.SystemMetric, p AnomalyParams, rng *rand.Rand) error {
+	// Calculate the mean and standard deviation of the field in the window
+	var sum, squareSum float64
+	for _, m := range metrics.Metrics {
+		value, err := m.Get(p["field"])
+		if err != nil {
+			return err
+		}
+		sum += value
+		squareSum += value * value
+	}
+	n := float64(len(metrics.Metrics))
+	mean := sum / n
+	stddev := math.Sqrt(math.Max(squareSum/n-mean*mean, 0))
+	if stddev == 0 {
+		stddev = math.Abs(mean) / 10
 	}
+	if stddev == 0 {
+		stddev = 1
+	}
+
+	return transformField(metrics, p["field"], func(_ int, _ *system_metrics.Metric, value float64) float64 {
+		return value + rng.NormFloat64()*stddev*p.Float("factor")
+	})
+}
 
-	// Call the transformation function found in the AnomalyMap
-	if err := AnomalyMap[anomalyFlag](metrics); err != nil {
+// Stuck sensor. Field keeps the value of the first metric in the window for the whole window
+func flatline(metrics *system_metrics.SystemMetric, p AnomalyParams, _ *rand.Rand) error {
+	stuck, err := metrics.Metrics[0].Get(p["field"])
+	if err != nil {
 		return err
 	}
+	return transformField(metrics, p["field"], func(_ int, _ *system_metrics.Metric, _ float64) float64 {
+		return stuck
+	})
+}
+
+// Missing data. Removes metrics from the window, each metric is removed with the given probability
+func dropout(metrics *system_metrics.SystemMetric, p AnomalyParams, rng *rand.Rand) error {
+	// A new slice is used so the metrics outside the window are not overwritten
+	kept := []*system_metrics.Metric{}
+	for _, m := range metrics.Metrics {
+		if rng.Float64() >= p.Float("probability") {
+			kept = append(kept, m)
+		}
+	}
+	metrics.Metrics = kept
 
 	return nil
 }
 
-// Basic example anomaly. Sets Cpu_User to 1 for all metrics
-func cpuUserHigh(metrics *system_metrics.SystemMetric) error {
+// Memory leak scenario. A process leaks rate (e.g. 0.05 is 5%) of the total memory for every per duration that has passed
+// since the start of the window. The leaked memory is first taken from the free memory alone until only pressure (a
+// fraction of the total memory) is free. Below that, the cache and buffers are reclaimed as well, the closer the free
+// memory gets to min-free the more of the leak they give up, so the free memory approaches min-free without reaching
+// it. When the cache and buffers are exhausted the free memory goes down to min-free and then memory is swapped out.
+// The available memory shrinks with the memory taken from free memory, cache and buffers.
+// All memory fields stay consistent with the total memory, nothing is ever negative or larger than the total.
+func memoryLeak(metrics *system_metrics.SystemMetric, p AnomalyParams, _ *rand.Rand) error {
+	if err := requireFields(metrics, "sys-mem-total", "sys-mem-free", "sys-mem-cache", "sys-mem-buffered", "sys-mem-available", "sys-mem-swap-free"); err != nil {
+		return err
+	}
+	per := p.Duration("per").Seconds()
 	for _, m := range metrics.Metrics {
-		m.Cpu_User = 1
+		total := m.Values["sys-mem-total"]
+		leaked := p.Float("rate") * total * elapsed(metrics, m) / per
+
+		// The leak is first taken from the free memory alone
+		free := m.Values["sys-mem-free"]
+		minFree := p.Float("min-free") * total
+		pressure := math.Max(p.Float("pressure")*total, minFree)
+		fromFree := math.Min(leaked, math.Max(free-pressure, 0))
+		leaked -= fromFree
+
+		// Under pressure the free memory above min-free shrinks exponentially with the leak and the rest of the leak is
+		// taken from the cache and buffers, so reclaiming them starts gradually
+		// A tenth of the cache and buffers is kept for the hottest pages
+		cache, buffered := m.Values["sys-mem-cache"], m.Values["sys-mem-buffered"]
+		reclaimable := (cache + buffered) * 0.9
+		aboveMin := math.Max(math.Min(free-fromFree, pressure)-minFree, 0)
+		fromZone := math.Min(leaked, aboveMin)
+		if width := pressure - minFree; width > 0 {
+			fromZone = aboveMin * (1 - math.Exp(-leaked/width))
+		}
+		fromCache := math.Min(leaked-fromZone, reclaimable)
+		// Once the cache and buffers are exhausted the free memory is used down to min-free
+		fromZone = math.Min(leaked-fromCache, aboveMin)
+		fromFree += fromZone
+		leaked -= fromZone + fromCache
+
+		// When there is nothing left to reclaim, memory is swapped out until the swap is full
+		swapFree := m.Values["sys-mem-swap-free"]
+		toSwap := math.Min(leaked, swapFree)
+
+		m.Values["sys-mem-free"] = math.Round(free - fromFree)
+		if cache+buffered > 0 {
+			// The cache and buffers shrink proportionally to their size
+			m.Values["sys-mem-cache"] = math.Round(cache - fromCache*cache/(cache+buffered))
+			m.Values["sys-mem-buffered"] = math.Round(buffered - fromCache*buffered/(cache+buffered))
+		}
+		m.Values["sys-mem-swap-free"] = math.Round(swapFree - toSwap)
+
+		// The available memory can never be lower than the free memory or higher than the total memory
+		available := m.Values["sys-mem-available"] - fromFree - fromCache
+		m.Values["sys-mem-available"] = math.Round(math.Min(math.Max(available, m.Values["sys-mem-free"]), total))
+	}
+
+	return nil
+}
+
+// rebootIdleFields are the fields that are 0 while the server is down in the reboot anomaly
+var rebootIdleFields = []string{"load-1m", "load-5m", "load-15m", "sys-fork-rate", "sys-interrupt-rate", "sys-context-switch-rate",
+	"disk-io-time", "disk-bytes-read", "disk-bytes-written", "disk-io-read", "disk-io-write", "cpu-iowait", "cpu-system", "cpu-user"}
+
+// Server crash and reboot scenario. The server is down for the down duration at the start of the window, the rest of the
+// window is spent recovering. While the server is down, server-up is 0 and the load averages, rates and CPU times are 0.
+// If drop is set, only the first metric of the outage is kept and the rest are removed as if the server stopped reporting.
+// After the reboot the load averages start from 0 and catch up with their 1, 5 and 15 minute time constants like the
+// kernel's exponential moving averages do. The swap is empty and the cache and buffers start over at a tenth of their
+// size and grow back with the recovery time constant, the memory they do not use is free.
+func reboot(metrics *system_metrics.SystemMetric, p AnomalyParams, _ *rand.Rand) error {
+	if err := requireFields(metrics, rebootIdleFields...); err != nil {
+		return err
+	}
+	if err := requireFields(metrics, "server-up", "sys-mem-free", "sys-mem-cache", "sys-mem-buffered", "sys-mem-swap-free", "sys-mem-swap-total"); err != nil {
+		return err
+	}
+	down := p.Duration("down").Seconds()
+	recovery := p.Duration("recovery").Seconds()
+
+	kept := []*system_metrics.Metric{}
+	for _, m := range metrics.Metrics {
+		t := elapsed(metrics, m)
+		if t < down {
+			// Keep the first metric of the outage so the outage is visible even if the metrics are dropped
+			if p.Bool("drop") && len(kept) > 0 && kept[len(kept)-1].Values["server-up"] == 0 {
+				continue
+			}
+			m.Values["server-up"] = 0
+			for _, field := range rebootIdleFields {
+				m.Values[field] = 0
+			}
+			kept = append(kept, m)
+			continue
+		}
+
+		// Time since the server came back up
+		t -= down
+
+		// The load averages are exponential moving averages that start from 0 after a reboot
+		m.Values["load-1m"] *= 1 - math.Exp(-t/60)
+		m.Values["load-5m"] *= 1 - math.Exp(-t/300)
+		m.Values["load-15m"] *= 1 - math.Exp(-t/900)
+
+		// The cache and buffers are empty after a reboot and grow back, the memory they do not use yet is free
+		growth := 1 - 0.9*math.Exp(-t/recovery)
+		cache, buffered := math.Round(m.Values["sys-mem-cache"]*growth), math.Round(m.Values["sys-mem-buffered"]*growth)
+		m.Values["sys-mem-free"] += m.Values["sys-mem-cache"] - cache + m.Values["sys-mem-buffered"] - buffered
+		m.Values["sys-mem-cache"], m.Values["sys-mem-buffered"] = cache, buffered
+		m.Values["sys-mem-swap-free"] = m.Values["sys-mem-swap-total"]
+		kept = append(kept, m)
 	}
+	metrics.Metrics = kept
 
 	return nil
 }
 
-// Changes Cpu_User to a timestamp based sin function (absolut value of sin)
-func cpuUserSin(metrics *system_metrics.SystemMetric) error {
+// Disk I/O saturation scenario. The disk I/O time, operations and bytes are multiplied by factor and the CPU spends at
+// least iowait (a fraction of the CPU time) waiting for I/O. User and system CPU time are scaled down so the CPU times
+// never add up to more than 1. The processes blocked on I/O add load to the load averages, the 1, 5 and 15 minute
+// averages follow with their natural lag since they are exponential moving averages of the number of waiting processes.
+func ioSaturation(metrics *system_metrics.SystemMetric, p AnomalyParams, _ *rand.Rand) error {
+	disk := []string{"disk-io-time", "disk-io-read", "disk-io-write", "disk-bytes-read", "disk-bytes-written"}
+	if err := requireFields(metrics, append(disk, "cpu-iowait", "cpu-user", "cpu-system", "load-1m", "load-5m", "load-15m")...); err != nil {
+		return err
+	}
 	for _, m := range metrics.Metrics {
-		m.Cpu_User = math.Abs(math.Sin(float64(m.Timestamp / 10)))
+		for _, field := range disk {
+			m.Values[field] *= p.Float("factor")
+		}
+
+		// The CPU time not spent waiting for I/O is shared by user and system in the same proportions as before
+		if m.Values["cpu-iowait"] < p.Float("iowait") {
+			m.Values["cpu-iowait"] = p.Float("iowait")
+		}
+		if busy := m.Values["cpu-user"] + m.Values["cpu-system"]; busy > 1-m.Values["cpu-iowait"] {
+			scale := math.Max(1-m.Values["cpu-iowait"], 0) / busy
+			m.Values["cpu-user"] *= scale
+			m.Values["cpu-system"] *= scale
+		}
+
 	}
 
+	// The blocked processes are added to the load as soon as the disk is saturated
+	addLoad(metrics, func(_ float64) float64 {
+		return p.Float("load")
+	})
+
+	return nil
+}
+
+// Fork bomb scenario. The fork rate and context switch rate are multiplied by factor and the CPU spends at least system
+// (a fraction of the CPU time) in the kernel. User and I/O wait time are scaled down so the CPU times never add up to
+// more than 1. The number of processes grows by growth per minute until the process limit is reached, which makes the
+// load averages climb.
+func forkBomb(metrics *system_metrics.SystemMetric, p AnomalyParams, _ *rand.Rand) error {
+	if err := requireFields(metrics, "sys-fork-rate", "sys-context-switch-rate", "cpu-system", "cpu-user", "cpu-iowait", "load-1m", "load-5m", "load-15m"); err != nil {
+		return err
+	}
+	for _, m := range metrics.Metrics {
+		m.Values["sys-fork-rate"] *= p.Float("factor")
+		m.Values["sys-context-switch-rate"] *= p.Float("factor")
+
+		// The CPU time not spent in the kernel is shared by user and I/O wait in the same proportions as before
+		if m.Values["cpu-system"] < p.Float("system") {
+			m.Values["cpu-system"] = p.Float("system")
+		}
+		if rest := m.Values["cpu-user"] + m.Values["cpu-iowait"]; rest > 1-m.Values["cpu-system"] {
+			scale := math.Max(1-m.Values["cpu-system"], 0) / rest
+			m.Values["cpu-user"] *= scale
+			m.Values["cpu-iowait"] *= scale
+		}
+	}
+
+	// Every new process is runnable and adds to the load until the process limit is reached
+	addLoad(metrics, func(t float64) float64 {
+		return math.Min(p.Float("growth")*t/60, p.Float("limit"))
+	})
+
+	return nil
+}
+
+// Thermal runaway scenario. The temperature rises by rate degrees per minute until it has risen by throttle degrees.
+// At that point the CPU is throttled, the temperature stops rising and user and system CPU time are capped at cap (a
+// fraction of the CPU time). Since the CPU can not keep up, load extra processes are waiting which raises the load averages.
+func thermalRunaway(metrics *system_metrics.SystemMetric, p AnomalyParams, _ *rand.Rand) error {
+	if err := requireFields(metrics, "sys-thermal", "cpu-user", "cpu-system", "load-1m", "load-5m", "load-15m"); err != nil {
+		return err
+	}
+	// The time at which the temperature has risen enough for the CPU to be throttled
+	throttleAt := p.Float("throttle") / p.Float("rate") * 60
+
+	for _, m := range metrics.Metrics {
+		t := elapsed(metrics, m)
+		m.Values["sys-thermal"] += math.Min(p.Float("rate")*t/60, p.Float("throttle"))
+
+		// The throttled CPU can not spend more than cap on user and system time
+		if busy := m.Values["cpu-user"] + m.Values["cpu-system"]; t >= throttleAt && busy > p.Float("cap") {
+			scale := p.Float("cap") / busy
+			m.Values["cpu-user"] *= scale
+			m.Values["cpu-system"] *= scale
+		}
+	}
+
+	// The work the throttled CPU can not keep up with is added to the load
+	addLoad(metrics, func(t float64) float64 {
+		if t >= throttleAt {
+			return p.Float("load")
+		}
+		return 0
+	})
+
+	return nil
+}
+
+// Contextual anomaly. Every metric in the window is replaced by the metric shift earlier in the series, or shift later if
+// ahead is set, keeping its timestamp. The values are normal for the host but not for the time they occur at.
+// If there is no metric at exactly that time, the closest metric before it is used.
+// Returns an error if the replayed metrics are outside of the series, nothing is changed in that case.
+func timeShift(metrics *system_metrics.SystemMetric, series []system_metrics.Metric, p AnomalyParams, _ *rand.Rand) error {
+	shift, direction := int64(p.Duration("shift").Seconds()), "later"
+	if !p.Bool("ahead") {
+		shift, direction = -shift, "earlier"
+	}
+
+	// Check the whole window before changing anything, the metrics are sorted so only the first and last need checking
+	first, last := metrics.Metrics[0].Timestamp+shift, metrics.Metrics[len(metrics.Metrics)-1].Timestamp+shift
+	if first < series[0].Timestamp || last > series[len(series)-1].Timestamp {
+		return fmt.Errorf("the metrics %v %s than the window are outside of the simulated metrics", p["shift"], direction)
+	}
+
+	for _, m := range metrics.Metrics {
+		source := m.Timestamp + shift
+		// The index of the last metric at or before the source timestamp
+		i := sort.Search(len(series), func(i int) bool { return series[i].Timestamp > source }) - 1
+		timestamp := m.Timestamp
+		// The same metric can be replayed more than once if the series has gaps, so every metric gets its own copy
+		*m = series[i].Copy()
+		m.Timestamp = timestamp
+	}
+	return nil
+}
+
+// Contextual anomaly. The part of the window after split is moved to the start of the window and the part before it to
+// the end, keeping the timestamps of the metrics, so with a split of 0.5 the two halves swap places.
+func swap(metrics *system_metrics.SystemMetric, p AnomalyParams, _ *rand.Rand) error {
+	n := len(metrics.Metrics)
+	splitAt := float64(metrics.Metrics[0].Timestamp) + p.Float("split")*float64(metrics.Metrics[n-1].Timestamp-metrics.Metrics[0].Timestamp)
+	k := sort.Search(n, func(i int) bool { return float64(metrics.Metrics[i].Timestamp) >= splitAt })
+
+	values := make([]system_metrics.Metric, n)
+	for i, m := range metrics.Metrics {
+		values[i] = m.Copy()
+	}
+	for i, m := range metrics.Metrics {
+		timestamp := m.Timestamp
+		*m = values[(i+k)%n]
+		m.Timestamp = timestamp
+	}
 	return nil
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSplitParams(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []string
+		wantErr bool
+	}{
+		{list: "", want: nil},
+		{list: "  ", want: nil},
+		{list: "a=1", want: []string{"a=1"}},
+		{list: "a=1,b=2", want: []string{"a=1", "b=2"}},
+		{list: "a=1,", want: []string{"a=1", ""}},
+		{list: "a='1,2',b=3", want: []string{"a='1,2'", "b=3"}},
+		{list: `a="1,2",b=3`, want: []string{`a="1,2"`, "b=3"}},
+		{list: `a="it's",b=3`, want: []string{`a="it's"`, "b=3"}},
+		{list: "a=[1,2],b={c,d},e=f(1,(2,3))", want: []string{"a=[1,2]", "b={c,d}", "e=f(1,(2,3))"}},
+		{list: "a='1,2", wantErr: true},
+		{list: "a=[1,2", wantErr: true},
+		{list: "a=1]", wantErr: true},
+		{list: "a=(1,2]", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := splitParams(test.list)
+		if (err != nil) != test.wantErr {
+			t.Errorf("splitParams(%q) error = %v, want error %v", test.list, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitParams(%q) = %q, want %q", test.list, got, test.want)
+		}
+	}
+}
+
+func TestParseAnomalySpec(t *testing.T) {
+	duration := func(d time.Duration) *time.Duration { return &d }
+	tests := []struct {
+		spec        string
+		params      AnomalyParams
+		start       *time.Duration
+		duration    *time.Duration
+		hasSchedule bool
+		wantErr     bool
+	}{
+		{spec: "memory-leak", params: AnomalyParams{}},
+		{spec: "memory-leak()", params: AnomalyParams{}},
+		{spec: "spike(field=cpu-user)", params: AnomalyParams{"field": "cpu-user"}},
+		{spec: " spike( field = cpu-user , factor = 2 ) ", params: AnomalyParams{"field": "cpu-user", "factor": "2"}},
+		{spec: "spike(field='cpu-user')", params: AnomalyParams{"field": "cpu-user"}},
+		{spec: "spike(field=cpu-user,start=1h,duration=1d)", params: AnomalyParams{"field": "cpu-user"}, start: duration(time.Hour), duration: duration(24 * time.Hour)},
+		{spec: "drift(field=cpu-user,per=1d,start=1d)", params: AnomalyParams{"field": "cpu-user", "per": "1d"}, start: duration(24 * time.Hour)},
+		{spec: "drift(field=cpu-user,per=1h30m)", params: AnomalyParams{"field": "cpu-user", "per": "1h30m"}},
+		{spec: "cpu-user-high(schedule='0 2,14 * * *',duration=10m)", params: AnomalyParams{}, duration: duration(10 * time.Minute), hasSchedule: true},
+		{spec: `cpu-user-high(schedule="*/30 9-17 * * 1-5",duration=2m)`, params: AnomalyParams{}, duration: duration(2 * time.Minute), hasSchedule: true},
+		{spec: "cpu-user-high(schedule=every 24h at 02:00,duration=20m)", params: AnomalyParams{}, duration: duration(20 * time.Minute), hasSchedule: true},
+
+		// A comma in an unquoted value splits the parameter list
+		{spec: "cpu-user-high(schedule=0 2,14 * * *,duration=10m)", wantErr: true},
+		{spec: "cpu-user-high(duration=10m,schedule=0 2,14 * * *)", wantErr: true},
+		{spec: "cpu-user-high(schedule='0 2 * * *,duration=10m)", wantErr: true},
+		{spec: "spike(field=cpu-user,)", wantErr: true},
+		{spec: "spike(,field=cpu-user)", wantErr: true},
+		{spec: "spike(field=)", wantErr: true},
+		{spec: "spike(field='')", wantErr: true},
+		{spec: "spike(=cpu-user)", wantErr: true},
+		{spec: "spike(field)", wantErr: true},
+		{spec: "spike(field=cpu-user,field=cpu-system)", wantErr: true},
+		{spec: "spike(field=cpu-user,start=1h,start=2h)", wantErr: true},
+		{spec: "spike(field=(cpu-user)", wantErr: true},
+		{spec: "spike(field=cpu-user,unknown=1)", wantErr: true},
+		{spec: "spike(field=cpu-user,probability=2)", wantErr: true},
+		{spec: "drift(field=cpu-user,per=0d)", wantErr: true},
+		{spec: "drift(field=cpu-user,per=1x)", wantErr: true},
+		{spec: "spike", wantErr: true},
+		{spec: "Spike(field=cpu-user)", wantErr: true},
+		{spec: "not-an-anomaly", wantErr: true},
+		{spec: "spike(field=cpu-user", wantErr: true},
+		{spec: "cpu-user-high(schedule=0 2 * * *)", wantErr: true},
+		{spec: "cpu-user-high(schedule=0 2 * * *,start=1h,duration=1h)", wantErr: true},
+	}
+	for _, test := range tests {
+		spec, err := ParseAnomalySpec(test.spec)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseAnomalySpec(%q) error = %v, want error %v", test.spec, err, test.wantErr)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		if !reflect.DeepEqual(spec.Params, test.params) {
+			t.Errorf("ParseAnomalySpec(%q) params = %v, want %v", test.spec, spec.Params, test.params)
+		}
+		if !reflect.DeepEqual(spec.Start, test.start) || !reflect.DeepEqual(spec.Duration, test.duration) {
+			t.Errorf("ParseAnomalySpec(%q) window = %v, %v, want %v, %v", test.spec, spec.Start, spec.Duration, test.start, test.duration)
+		}
+		if (spec.Schedule != nil) != test.hasSchedule {
+			t.Errorf("ParseAnomalySpec(%q) schedule = %v, want schedule %v", test.spec, spec.Schedule, test.hasSchedule)
+		}
+	}
+}
+
+// exampleValues are plausible values of the fields of the dataset provided by Westermo
+var exampleValues = map[string]float64{
+	"load-1m": 1, "load-5m": 1, "load-15m": 1,
+	"sys-mem-swap-total": 500, "sys-mem-swap-free": 400,
+	"sys-mem-free": 300, "sys-mem-cache": 300, "sys-mem-buffered": 100, "sys-mem-available": 600, "sys-mem-total": 1000,
+	"sys-fork-rate": 10, "sys-interrupt-rate": 100, "sys-context-switch-rate": 200, "sys-thermal": 50,
+	"disk-io-time": 0.1, "disk-bytes-read": 1000, "disk-bytes-written": 1000, "disk-io-read": 10, "disk-io-write": 10,
+	"cpu-iowait": 0.05, "cpu-system": 0.1, "cpu-user": 0.2, "server-up": 1,
+}
+
+func TestAnomalyExamples(t *testing.T) {
+	names := []string{}
+	for name := range AnomalyMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		example := AnomalyMap[name].Example
+		if _, err := ParseAnomalySpec(example); err != nil {
+			t.Errorf("%s: ParseAnomalySpec(%q) error = %v", name, example, err)
+			continue
+		}
+
+		// Two days of metrics, one every minute
+		values := make([]map[string]float64, 2*24*60)
+		for i := range values {
+			values[i] = exampleValues
+		}
+		metrics := testMetrics(values...)
+		truths, err := InjectAnomalies(metrics, []string{example}, nil, time.Hour, 2*time.Hour, time.Unix(0, 0), rand.New(rand.NewSource(1)))
+		if err != nil {
+			t.Errorf("%s: InjectAnomalies(%q) error = %v", name, example, err)
+			continue
+		}
+		if len(truths) != 1 || len(truths[0].Labels) == 0 {
+			t.Errorf("%s: InjectAnomalies(%q) ground truth = %v, want one labeled window", name, example, truths)
+		}
+	}
+}
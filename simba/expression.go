@@ -0,0 +1,523 @@
+package main
+
+import (
+	"fmt"
+	"internal/system_metrics"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// An anomaly expression assigns the result of arithmetic expressions to metric fields, e.g.
+//
+//	cpu-user = min(1, cpu-user*1.8 + 0.05*sin(t/300))
+//
+// Several assignments can be separated by semicolons, they are evaluated in order for every metric so later
+// assignments see the values set by earlier ones. The expressions can use the metric fields by their names, the
+// elapsed time t in seconds since the start of the anomaly window, the constants pi and e, the operators + - * / % ^
+// and the functions in exprFunctions.
+// Since the field names contain hyphens (e.g. cpu-user or load-1m), a name with hyphens is resolved against the schema
+// of the metrics when the expression is injected: the longest runs of its parts that are fields are kept as names and
+// the other hyphens are minus signs. So cpu-user-cpu-system is cpu-user - cpu-system and t-60 is t - 60.
+
+// exprEnv is the environment an expression is evaluated in
+type exprEnv struct {
+	metric *system_metrics.Metric // The metric being transformed
+	t      float64                // Seconds since the start of the anomaly window
+	rng    *rand.Rand             // The source of the random functions
+}
+
+// exprNode is a node of a parsed expression, evaluating it returns its value in the environment
+type exprNode func(env *exprEnv) float64
+
+// exprFunction is a function that can be called in an expression
+type exprFunction struct {
+	args int // The number of arguments, -1 if the function takes one or more arguments
+	call func(args []float64, env *exprEnv) float64
+}
+
+// exprFunctions are the functions that can be called in an expression
+var exprFunctions = map[string]exprFunction{
+	"sin":   {1, func(a []float64, _ *exprEnv) float64 { return math.Sin(a[0]) }},
+	"cos":   {1, func(a []float64, _ *exprEnv) float64 { return math.Cos(a[0]) }},
+	"tan":   {1, func(a []float64, _ *exprEnv) float64 { return math.Tan(a[0]) }},
+	"exp":   {1, func(a []float64, _ *exprEnv) float64 { return math.Exp(a[0]) }},
+	"log":   {1, func(a []float64, _ *exprEnv) float64 { return math.Log(a[0]) }},
+	"sqrt":  {1, func(a []float64, _ *exprEnv) float64 { return math.Sqrt(a[0]) }},
+	"abs":   {1, func(a []float64, _ *exprEnv) float64 { return math.Abs(a[0]) }},
+	"floor": {1, func(a []float64, _ *exprEnv) float64 { return math.Floor(a[0]) }},
+	"ceil":  {1, func(a []float64, _ *exprEnv) float64 { return math.Ceil(a[0]) }},
+	"round": {1, func(a []float64, _ *exprEnv) float64 { return math.Round(a[0]) }},
+	"pow":   {2, func(a []float64, _ *exprEnv) float64 { return math.Pow(a[0], a[1]) }},
+	"clamp": {3, func(a []float64, _ *exprEnv) float64 { return math.Max(a[1], math.Min(a[2], a[0])) }},
+	"min": {-1, func(a []float64, _ *exprEnv) float64 {
+		result := a[0]
+		for _, v := range a[1:] {
+			result = math.Min(result, v)
+		}
+		return result
+	}},
+	"max": {-1, func(a []float64, _ *exprEnv) float64 {
+		result := a[0]
+		for _, v := range a[1:] {
+			result = math.Max(result, v)
+		}
+		return result
+	}},
+	// rand returns a uniformly distributed number in [0, 1) and randn a normally distributed number with mean 0
+	// and standard deviation 1. Both draw from the seeded source of the injection
+	"rand":  {0, func(_ []float64, env *exprEnv) float64 { return env.rng.Float64() }},
+	"randn": {0, func(_ []float64, env *exprEnv) float64 { return env.rng.NormFloat64() }},
+}
+
+// exprConstants are the named constants that can be used in an expression
+var exprConstants = map[string]float64{
+	"pi": math.Pi,
+	"e":  math.E,
+}
+
+// exprAssignment assigns the value of an expression to a field
+type exprAssignment struct {
+	field string
+	value exprNode
+}
+
+// Expression is a parsed anomaly expression, see ParseExpression.
+type Expression struct {
+	source      string
+	assignments []exprAssignment
+	fields      []string // The fields the expression uses or assigns, in the order they first appear
+}
+
+// ParseExpression parses an anomaly expression such as "cpu-user = min(1, cpu-user*1.8)".
+// Any name that is not t, a constant or a function is a field. The names with hyphens and whether the fields exist
+// depend on the schema of the metrics, so the expression is parsed again with the schema when it is injected.
+// Returns an error if the expression is malformed or uses unknown functions.
+func ParseExpression(source string) (*Expression, error) {
+	return parseExpression(source, nil)
+}
+
+// parseExpression parses an anomaly expression, the names with hyphens are split like tokenizeExpression does.
+// Returns an error if the expression is malformed or uses unknown functions.
+func parseExpression(source string, schema *system_metrics.Schema) (*Expression, error) {
+	tokens, err := tokenizeExpression(source, schema)
+	if err != nil {
+		return nil, fmt.Errorf("invalid anomaly expression '%s': %v", source, err)
+	}
+
+	p := exprParser{tokens: tokens, fields: map[string]bool{}}
+	expression := Expression{source: strings.TrimSpace(source)}
+	for {
+		assignment, err := p.assignment()
+		if err != nil {
+			return nil, fmt.Errorf("invalid anomaly expression '%s': %v", source, err)
+		}
+		expression.assignments = append(expression.assignments, assignment)
+		if !p.accept(";") {
+			break
+		}
+		// Allow a trailing semicolon
+		if p.peek() == "" {
+			break
+		}
+	}
+	if p.peek() != "" {
+		return nil, fmt.Errorf("invalid anomaly expression '%s': unexpected '%s'", source, p.peek())
+	}
+	expression.fields = p.order
+
+	return &expression, nil
+}
+
+// String returns the source of the expression
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Anomaly returns the expression as an anomaly that can be injected like the anomalies in the AnomalyMap.
+// The expression does not take any parameters.
+func (e *Expression) Anomaly() Anomaly {
+	return Anomaly{Transform: e.transform}
+}
+
+// transform evaluates the assignments of the expression for every metric
+// Returns an error if the metrics lack a field the expression uses or an assignment does not give a finite number
+func (e *Expression) transform(metrics *system_metrics.SystemMetric, _ AnomalyParams, rng *rand.Rand) error {
+	schema := metrics.Schema()
+	bound, err := parseExpression(e.source, schema)
+	if err != nil {
+		return err
+	}
+	for _, field := range bound.fields {
+		if !schema.Has(field) {
+			return fmt.Errorf("anomaly expression '%s' uses unknown field '%s'", e.source, field)
+		}
+	}
+
+	env := exprEnv{rng: rng}
+	for _, m := range metrics.Metrics {
+		env.metric = m
+		env.t = elapsed(metrics, m)
+		for _, a := range bound.assignments {
+			value := a.value(&env)
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				return fmt.Errorf("anomaly expression '%s' gives %v for %s at timestamp %v", e.source, value, a.field, m.Timestamp)
+			}
+			if err := m.Set(a.field, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tokenizeExpression splits an expression into numbers, names and operators.
+// A hyphen followed by a letter or digit continues a name (e.g. cpu-user or load-1m). If schema is nil the whole name
+// is kept, otherwise it is split with splitName.
+func tokenizeExpression(source string, schema *system_metrics.Schema) ([]string, error) {
+	tokens := []string{}
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || r == '.':
+			j := scanNumber(runes, i)
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(runes) {
+				if unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_' {
+					j++
+				} else if runes[j] == '-' && j+1 < len(runes) && unicode.IsDigit(runes[j+1]) {
+					// A whole number after a hyphen, e.g. the 0.1 of cpu-user-0.1, splitName finds where it ends
+					j = scanNumber(runes, j+1)
+				} else if runes[j] == '-' && j+1 < len(runes) && unicode.IsLetter(runes[j+1]) {
+					j++
+				} else {
+					break
+				}
+			}
+			if schema == nil {
+				tokens = append(tokens, string(runes[i:j]))
+			} else {
+				tokens = append(tokens, splitName(string(runes[i:j]), schema)...)
+			}
+			i = j
+		case strings.ContainsRune("+-*/%^(),=;", r):
+			tokens = append(tokens, string(r))
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character '%c'", r)
+		}
+	}
+	return tokens, nil
+}
+
+// scanNumber returns the end of the number starting at i, a number has an optional fraction and exponent, e.g. 1,
+// 0.5, .5 or 1e-3
+func scanNumber(runes []rune, i int) int {
+	j := i
+	for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.') {
+		j++
+	}
+	if j < len(runes) && (runes[j] == 'e' || runes[j] == 'E') {
+		k := j + 1
+		if k < len(runes) && (runes[k] == '+' || runes[k] == '-') {
+			k++
+		}
+		if k < len(runes) && unicode.IsDigit(runes[k]) {
+			for k < len(runes) && unicode.IsDigit(runes[k]) {
+				k++
+			}
+			j = k
+		}
+	}
+	return j
+}
+
+// splitHyphens splits a name at its hyphens, except the sign of the exponent of a number, e.g. t-1e-3 is t and 1e-3
+func splitHyphens(name string) []string {
+	parts := []string{}
+	start := 0
+	for i, r := range name {
+		if r != '-' {
+			continue
+		}
+		part := name[start:i]
+		if part != "" && unicode.IsDigit(rune(part[0])) && strings.ContainsAny(part[len(part)-1:], "eE") {
+			if _, err := strconv.ParseFloat(part[:len(part)-1], 64); err == nil {
+				continue
+			}
+		}
+		parts = append(parts, part)
+		start = i + 1
+	}
+	return append(parts, name[start:])
+}
+
+// splitName splits a name with hyphens into names and minus signs. The longest runs of its parts that are fields of
+// the schema are names, e.g. cpu-user-cpu-system is cpu-user - cpu-system. The other parts must be t, a constant or a
+// number, e.g. t-60 is t - 60. Otherwise the name is kept whole so that it is reported as an unknown field.
+func splitName(name string, schema *system_metrics.Schema) []string {
+	if schema.Has(name) || !strings.Contains(name, "-") {
+		return []string{name}
+	}
+	parts := splitHyphens(name)
+	tokens := []string{}
+	for i := 0; i < len(parts); {
+		if i > 0 {
+			tokens = append(tokens, "-")
+		}
+		end := len(parts)
+		for end > i+1 && !schema.Has(strings.Join(parts[i:end], "-")) {
+			end--
+		}
+		part := strings.Join(parts[i:end], "-")
+		if end == i+1 && !schema.Has(part) {
+			_, isConstant := exprConstants[part]
+			_, err := strconv.ParseFloat(part, 64)
+			isNumber := unicode.IsDigit(rune(part[0])) && err == nil
+			if part != "t" && !isConstant && !isNumber {
+				return []string{name}
+			}
+		}
+		tokens = append(tokens, part)
+		i = end
+	}
+	return tokens
+}
+
+// exprParser is a recursive descent parser of anomaly expressions. The grammar is
+//
+//	assignment = field "=" sum
+//	sum        = product { ("+" | "-") product }
+//	product    = unary { ("*" | "/" | "%") unary }
+//	unary      = "-" unary | power
+//	power      = primary [ "^" unary ]
+//	primary    = number | name | name "(" [ sum { "," sum } ] ")" | "(" sum ")"
+type exprParser struct {
+	tokens []string
+	pos    int
+	fields map[string]bool // The fields used so far
+	order  []string        // The fields used so far in the order they first appear
+}
+
+// useField records that the expression uses the field
+func (p *exprParser) useField(field string) {
+	if !p.fields[field] {
+		p.fields[field] = true
+		p.order = append(p.order, field)
+	}
+}
+
+// peek returns the next token without consuming it, or an empty string at the end of the expression
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// accept consumes the next token if it is the given token and returns whether it did
+func (p *exprParser) accept(token string) bool {
+	if p.peek() == token {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// expect consumes the next token and returns an error if it is not the given token
+func (p *exprParser) expect(token string) error {
+	if !p.accept(token) {
+		if p.peek() == "" {
+			return fmt.Errorf("expected '%s' at the end of the expression", token)
+		}
+		return fmt.Errorf("expected '%s' but got '%s'", token, p.peek())
+	}
+	return nil
+}
+
+func (p *exprParser) assignment() (exprAssignment, error) {
+	field := p.peek()
+	_, isConstant := exprConstants[field]
+	_, isFunction := exprFunctions[field]
+	if field == "" || !(unicode.IsLetter(rune(field[0])) || field[0] == '_') || field == "t" || isConstant || isFunction {
+		return exprAssignment{}, fmt.Errorf("can only assign to metric fields, got '%s'", field)
+	}
+	p.useField(field)
+	p.pos++
+	if err := p.expect("="); err != nil {
+		return exprAssignment{}, err
+	}
+	value, err := p.sum()
+	if err != nil {
+		return exprAssignment{}, err
+	}
+	return exprAssignment{field: field, value: value}, nil
+}
+
+func (p *exprParser) sum() (exprNode, error) {
+	left, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != "+" && op != "-" {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == "+" {
+			left = func(env *exprEnv) float64 { return l(env) + right(env) }
+		} else {
+			left = func(env *exprEnv) float64 { return l(env) - right(env) }
+		}
+	}
+}
+
+func (p *exprParser) product() (exprNode, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != "*" && op != "/" && op != "%" {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		switch op {
+		case "*":
+			left = func(env *exprEnv) float64 { return l(env) * right(env) }
+		case "/":
+			left = func(env *exprEnv) float64 { return l(env) / right(env) }
+		default:
+			left = func(env *exprEnv) float64 { return math.Mod(l(env), right(env)) }
+		}
+	}
+}
+
+func (p *exprParser) unary() (exprNode, error) {
+	if p.accept("-") {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(env *exprEnv) float64 { return -operand(env) }, nil
+	}
+	return p.power()
+}
+
+func (p *exprParser) power() (exprNode, error) {
+	base, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept("^") {
+		return base, nil
+	}
+	// The exponent is parsed as a unary so that powers are right associative, 2^3^2 is 2^(3^2)
+	exponent, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	return func(env *exprEnv) float64 { return math.Pow(base(env), exponent(env)) }, nil
+}
+
+func (p *exprParser) primary() (exprNode, error) {
+	token := p.peek()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of the expression")
+	case token == "(":
+		p.pos++
+		inner, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	case unicode.IsDigit(rune(token[0])) || token[0] == '.':
+		p.pos++
+		value, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s'", token)
+		}
+		return func(_ *exprEnv) float64 { return value }, nil
+	case unicode.IsLetter(rune(token[0])) || token[0] == '_':
+		p.pos++
+		if p.peek() == "(" {
+			return p.call(token)
+		}
+		return p.name(token)
+	}
+	return nil, fmt.Errorf("unexpected '%s'", token)
+}
+
+// name resolves a name to the elapsed time, a constant or a metric field, any other name is a field
+func (p *exprParser) name(name string) (exprNode, error) {
+	if name == "t" {
+		return func(env *exprEnv) float64 { return env.t }, nil
+	}
+	if value, exists := exprConstants[name]; exists {
+		return func(_ *exprEnv) float64 { return value }, nil
+	}
+	p.useField(name)
+	return func(env *exprEnv) float64 {
+		// The field is checked to exist before the expression is evaluated so Get can not fail
+		value, _ := env.metric.Get(name)
+		return value
+	}, nil
+}
+
+// call parses the arguments of a function call, the name of the function has already been consumed
+func (p *exprParser) call(name string) (exprNode, error) {
+	function, exists := exprFunctions[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown function '%s'", name)
+	}
+	p.pos++ // Consume the opening parenthesis
+
+	args := []exprNode{}
+	if !p.accept(")") {
+		for {
+			arg, err := p.sum()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.accept(")") {
+				break
+			}
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if (function.args == -1 && len(args) == 0) || (function.args != -1 && len(args) != function.args) {
+		return nil, fmt.Errorf("wrong number of arguments to %s: %d", name, len(args))
+	}
+
+	return func(env *exprEnv) float64 {
+		values := make([]float64, len(args))
+		for i, arg := range args {
+			values[i] = arg(env)
+		}
+		return function.call(values, env)
+	}, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"internal/system_metrics"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestTokenizeExpression(t *testing.T) {
+	schema := system_metrics.WestermoSchema
+	tests := []struct {
+		source  string
+		schema  *system_metrics.Schema
+		want    []string
+		wantErr bool
+	}{
+		{source: "cpu-user = 1", want: []string{"cpu-user", "=", "1"}},
+		{source: "cpu-user=cpu-user*1.8+.5", schema: schema, want: []string{"cpu-user", "=", "cpu-user", "*", "1.8", "+", ".5"}},
+		{source: "x = 1e-3 + 2E+2 - 3e", want: []string{"x", "=", "1e-3", "+", "2E+2", "-", "3", "e"}},
+		{source: "x = -(t)^2 % 3; y = f(a, b)", want: []string{"x", "=", "-", "(", "t", ")", "^", "2", "%", "3", ";", "y", "=", "f", "(", "a", ",", "b", ")"}},
+		{source: "load-1m = t-60", want: []string{"load-1m", "=", "t-60"}},
+		{source: "load-1m = t-60", schema: schema, want: []string{"load-1m", "=", "t", "-", "60"}},
+		{source: "x = cpu-user-cpu-system", schema: schema, want: []string{"x", "=", "cpu-user", "-", "cpu-system"}},
+		{source: "x = cpu-user-1", schema: schema, want: []string{"x", "=", "cpu-user", "-", "1"}},
+		{source: "cpu-user = cpu-user-0.1", schema: schema, want: []string{"cpu-user", "=", "cpu-user", "-", "0.1"}},
+		{source: "x = t-1.5", schema: schema, want: []string{"x", "=", "t", "-", "1.5"}},
+		{source: "x = t-1e-3*2", schema: schema, want: []string{"x", "=", "t", "-", "1e-3", "*", "2"}},
+		{source: "x = load-1m-2.5e+1", schema: schema, want: []string{"x", "=", "load-1m", "-", "2.5e+1"}},
+		{source: "x = cpu-user-pi-e", schema: schema, want: []string{"x", "=", "cpu-user", "-", "pi", "-", "e"}},
+		{source: "x = cpu-user - cpu-system", schema: schema, want: []string{"x", "=", "cpu-user", "-", "cpu-system"}},
+		{source: "x = cpu-users", schema: schema, want: []string{"x", "=", "cpu-users"}},
+		{source: "x = cpu-user-foo", schema: schema, want: []string{"x", "=", "cpu-user-foo"}},
+		{source: "x = cpu-user-inf", schema: schema, want: []string{"x", "=", "cpu-user-inf"}},
+		{source: "x = a- b", want: []string{"x", "=", "a", "-", "b"}},
+		{source: "x = a -b", want: []string{"x", "=", "a", "-", "b"}},
+		{source: "x = 1 $ 2", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := tokenizeExpression(test.source, test.schema)
+		if (err != nil) != test.wantErr {
+			t.Errorf("tokenizeExpression(%q) error = %v, want error %v", test.source, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("tokenizeExpression(%q) = %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+// testMetrics returns metrics with the fields of the dataset provided by Westermo, one every minute
+func testMetrics(values ...map[string]float64) *system_metrics.SystemMetric {
+	metrics := system_metrics.SystemMetric{Id: "test"}
+	for i, v := range values {
+		m := system_metrics.NewMetric(system_metrics.WestermoSchema, int64(60*i))
+		for name, value := range v {
+			m.Values[name] = value
+		}
+		metrics.Metrics = append(metrics.Metrics, m)
+	}
+	return &metrics
+}
+
+func TestExpressionEvaluate(t *testing.T) {
+	fields := map[string]float64{"cpu-user": 0.5, "cpu-system": 0.25, "load-1m": 2}
+	tests := []struct {
+		source string
+		field  string
+		want   float64
+	}{
+		// Precedence and associativity
+		{source: "cpu-user = 1 + 2 * 3", field: "cpu-user", want: 7},
+		{source: "cpu-user = (1 + 2) * 3", field: "cpu-user", want: 9},
+		{source: "cpu-user = 10 - 4 - 3", field: "cpu-user", want: 3},
+		{source: "cpu-user = 24 / 4 / 2", field: "cpu-user", want: 3},
+		{source: "cpu-user = 7 % 4 * 2", field: "cpu-user", want: 6},
+		{source: "cpu-user = 2 ^ 3 ^ 2", field: "cpu-user", want: 512},
+		{source: "cpu-user = 2 * 3 ^ 2", field: "cpu-user", want: 18},
+
+		// Unary minus
+		{source: "cpu-user = -2", field: "cpu-user", want: -2},
+		{source: "cpu-user = --2", field: "cpu-user", want: 2},
+		{source: "cpu-user = -2 ^ 2", field: "cpu-user", want: -4},
+		{source: "cpu-user = 2 ^ -1", field: "cpu-user", want: 0.5},
+		{source: "cpu-user = 3 * -cpu-system", field: "cpu-user", want: -0.75},
+		{source: "cpu-user = 1 - -1", field: "cpu-user", want: 2},
+
+		// Fields, hyphens, t and constants
+		{source: "cpu-user = cpu-user-cpu-system", field: "cpu-user", want: 0.25},
+		{source: "cpu-user = cpu-user - cpu-system", field: "cpu-user", want: 0.25},
+		{source: "load-1m = load-1m*2", field: "load-1m", want: 4},
+		{source: "cpu-user = t-60", field: "cpu-user", want: -60},
+		{source: "cpu-user = t-1.5", field: "cpu-user", want: -1.5},
+		{source: "cpu-user = cpu-user-0.1", field: "cpu-user", want: 0.4},
+		{source: "cpu-user = cpu-user-1e-1", field: "cpu-user", want: 0.4},
+		{source: "cpu-user = pi-e", field: "cpu-user", want: math.Pi - math.E},
+		{source: "cpu-user = 0.9; cpu-system = cpu-user + 0.1", field: "cpu-system", want: 1},
+		{source: "cpu-user = 0.9;", field: "cpu-user", want: 0.9},
+
+		// Functions
+		{source: "cpu-user = abs(-2) + floor(1.5) + ceil(1.5) + round(2.5)", field: "cpu-user", want: 8},
+		{source: "cpu-user = sqrt(16) + exp(0) + log(1) + sin(0) + cos(0) + tan(0)", field: "cpu-user", want: 6},
+		{source: "cpu-user = pow(2, 10)", field: "cpu-user", want: 1024},
+		{source: "cpu-user = clamp(cpu-user * 3, 0, 1)", field: "cpu-user", want: 1},
+		{source: "cpu-user = min(3, 1, 2) + max(3, 1, 2) + min(5)", field: "cpu-user", want: 9},
+		{source: "cpu-user = floor(rand())", field: "cpu-user", want: 0},
+	}
+	for _, test := range tests {
+		expression, err := ParseExpression(test.source)
+		if err != nil {
+			t.Errorf("ParseExpression(%q) error = %v", test.source, err)
+			continue
+		}
+		metrics := testMetrics(fields)
+		if err := expression.transform(metrics, AnomalyParams{}, rand.New(rand.NewSource(1))); err != nil {
+			t.Errorf("%q: transform error = %v", test.source, err)
+			continue
+		}
+		if got, _ := metrics.Metrics[0].Get(test.field); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%q: %s = %v, want %v", test.source, test.field, got, test.want)
+		}
+	}
+}
+
+func TestExpressionElapsedTime(t *testing.T) {
+	expression, err := ParseExpression("cpu-user = t/60")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := testMetrics(nil, nil, nil)
+	if err := expression.transform(metrics, AnomalyParams{}, rand.New(rand.NewSource(1))); err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range metrics.Metrics {
+		if got := m.Values["cpu-user"]; got != float64(i) {
+			t.Errorf("cpu-user of metric %d = %v, want %v", i, got, i)
+		}
+	}
+}
+
+func TestExpressionErrors(t *testing.T) {
+	// Errors found when the expression is parsed
+	for _, source := range []string{
+		"",
+		"cpu-user",
+		"cpu-user =",
+		"cpu-user = 1 +",
+		"cpu-user = (1",
+		"cpu-user = 1)",
+		"cpu-user = 1 2",
+		"cpu-user = 1 $ 2",
+		"cpu-user = 1..2",
+		"cpu-user = foo(1)",
+		"cpu-user = sin()",
+		"cpu-user = sin(1, 2)",
+		"cpu-user = pow(1)",
+		"cpu-user = min()",
+		"cpu-user = rand(1)",
+		"t = 1",
+		"pi = 1",
+		"sin = 1",
+		"1 = 1",
+		"cpu-user = 1;; cpu-system = 1",
+	} {
+		if _, err := ParseExpression(source); err == nil {
+			t.Errorf("ParseExpression(%q) succeeded, want error", source)
+		}
+	}
+
+	// Errors found when the expression is injected into metrics
+	for _, source := range []string{
+		"cpu-users = 1",
+		"cpu-user = cpu-users",
+		"cpu-user = cpu-user-foo",
+		"cpu-user = load-1x",
+		"cpu-user = 1 / 0",
+		"cpu-user = log(-1)",
+	} {
+		expression, err := ParseExpression(source)
+		if err != nil {
+			t.Errorf("ParseExpression(%q) error = %v", source, err)
+			continue
+		}
+		if err := expression.transform(testMetrics(nil), AnomalyParams{}, rand.New(rand.NewSource(1))); err == nil {
+			t.Errorf("%q: transform succeeded, want error", source)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"internal/system_metrics"
+	"log"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Plugins are anomalies implemented as external executables, written in any language.
+// Plugins are only loaded if a plugin directory is given with --plugin-dir or SIMBA_PLUGIN_DIR, so running simba in
+// a directory that happens to contain executables does not run them. The executables are discovered in the plugin
+// directory and registered in the AnomalyMap under their file name
+// without the extension, so plugins/square-wave.py becomes the square-wave anomaly.
+//
+// The protocol is simple so plugins are easy to write:
+//   - The metrics of the anomaly window are written to the standard input of the executable as CSV, in the same
+//     format as the dataset provided by Westermo.
+//   - The parameters of the anomaly spec are passed as key=value arguments, ordered by key.
+//     Plugins accept any parameters, it is up to the plugin to validate them.
+//   - The SIMBA_SEED environment variable contains a seed drawn from the seeded source of the injection. Plugins that
+//     use randomness should seed with it so the run can be replayed.
+//   - The executable writes the transformed metrics to its standard output in the same CSV format with the same
+//     columns. The timestamps must not change, but rows can be left out to remove metrics. Anything written to
+//     standard error is passed on.
+//   - A non-zero exit code means the anomaly failed.
+
+// pluginDirEnv is the environment variable used to set the plugin directory, see the --plugin-dir flag
+const pluginDirEnv = "SIMBA_PLUGIN_DIR"
+
+// pluginNameRegex matches the valid names of plugins, the same names that are valid in an anomaly spec
+var pluginNameRegex = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// RegisterPlugins adds the plugins of the directory to the AnomalyMap, see LoadPlugins.
+// A plugin with the same name as a built-in anomaly is skipped with a warning.
+// Returns an error if the plugins can not be loaded.
+func RegisterPlugins(dir string) error {
+	plugins, err := LoadPlugins(dir)
+	if err != nil {
+		return fmt.Errorf("could not load plugins: %v", err)
+	}
+	for name, anomaly := range plugins {
+		if _, exists := AnomalyMap[name]; exists {
+			log.Printf("Skipping plugin %s since an anomaly with the same name already exists\n", name)
+			continue
+		}
+		AnomalyMap[name] = anomaly
+	}
+	return nil
+}
+
+// LoadPlugins returns an anomaly for every executable file in the directory, see the protocol above.
+// The anomalies are keyed by the file name without the extension. Files that are not executable are ignored and
+// files that do not have a valid anomaly name are skipped with a warning.
+// Returns an error if the directory can not be read or if two plugins have the same name, e.g. foo and foo.sh.
+func LoadPlugins(dir string) (map[string]Anomaly, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	plugins := map[string]Anomaly{}
+	files := map[string]string{} // The file of every plugin by name
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		// Only regular files that are executable by someone are plugins
+		if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		if !pluginNameRegex.MatchString(name) {
+			log.Printf("Skipping plugin %s since it must be named with lower case letters, digits and hyphens only\n", entry.Name())
+			continue
+		}
+		if file, duplicate := files[name]; duplicate {
+			return nil, fmt.Errorf("plugins %s and %s have the same name %s", file, entry.Name(), name)
+		}
+		files[name] = entry.Name()
+		path, err := filepath.Abs(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		plugins[name] = Anomaly{
+			Transform:   pluginTransform(name, path),
+			OpenParams:  true,
+			Description: "Plugin " + path + ", accepts any parameters",
+			Example:     name,
+		}
+	}
+	return plugins, nil
+}
+
+// pluginTransform returns the transformation function of the plugin with the executable at path
+func pluginTransform(name, path string) func(*system_metrics.SystemMetric, AnomalyParams, *rand.Rand) error {
+	return func(metrics *system_metrics.SystemMetric, p AnomalyParams, rng *rand.Rand) error {
+		var input, output bytes.Buffer
+		if err := metrics.WriteCSV(&input); err != nil {
+			return err
+		}
+
+		// The parameters are sorted so the plugin is called the same way every time
+		keys := make([]string, 0, len(p))
+		for key := range p {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		args := make([]string, len(keys))
+		for i, key := range keys {
+			args[i] = key + "=" + p[key]
+		}
+
+		cmd := exec.Command(path, args...)
+		cmd.Env = append(os.Environ(), fmt.Sprintf("SIMBA_SEED=%d", rng.Int63()))
+		cmd.Stdin = &input
+		cmd.Stdout = &output
+		// Stderr must be set to os.Stderr to get the error output from the plugin
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("plugin %s failed: %v", name, err)
+		}
+
+		transformed, err := system_metrics.ReadCSV(&output, metrics.Id)
+		if err != nil {
+			return fmt.Errorf("plugin %s returned invalid metrics: %v", name, err)
+		}
+		if len(transformed.Metrics) > 0 && !sameFields(transformed.Schema(), metrics.Schema()) {
+			return fmt.Errorf("plugin %s returned the fields %v but was given %v", name, transformed.Schema().Names(), metrics.Schema().Names())
+		}
+
+		// Copy the transformed values into the original metrics, matched by timestamp
+		// The plugin may leave out metrics but it may not add metrics or change their order
+		kept := []*system_metrics.Metric{}
+		i := 0
+		for _, m := range transformed.Metrics {
+			for i < len(metrics.Metrics) && metrics.Metrics[i].Timestamp != m.Timestamp {
+				i++
+			}
+			if i == len(metrics.Metrics) {
+				return fmt.Errorf("plugin %s returned a metric with timestamp %v that is not in its input or out of order", name, m.Timestamp)
+			}
+			// Only the values are copied, the metric keeps the schema it shares with the rest of the series
+			metrics.Metrics[i].Timestamp = m.Timestamp
+			metrics.Metrics[i].Values = m.Values
+			kept = append(kept, metrics.Metrics[i])
+			i++
+		}
+		// A new slice is only used if metrics were removed so the metrics outside the window are not overwritten
+		if len(kept) != len(metrics.Metrics) {
+			metrics.Metrics = kept
+		}
+		return nil
+	}
+}
+
+// sameFields returns whether the schemas have the same fields, in any order
+func sameFields(a, b *system_metrics.Schema) bool {
+	if len(a.Names()) != len(b.Names()) {
+		return false
+	}
+	for _, name := range a.Names() {
+		if !b.Has(name) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"internal/influxdbapi"
+	"internal/system_metrics"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Scenario is a declarative description of a simulation of one or more hosts.
+// Scenarios are read from YAML or JSON files so they can be version controlled and shared.
+// The segments of every host are laid out back-to-back so that the last segment ends gap time before now.
+// A zero value for Scenario is not valid. Use LoadScenario to read and validate a scenario file.
+type Scenario struct {
+	Gap    string         `yaml:"gap"`    // Time to leave between the last metric and now. Duration string
+	Stream bool           `yaml:"stream"` // Whether to stream the last segment of every host in real time instead of filling it
+	Seed   *int64         `yaml:"seed"`   // Seed of the random draws of the anomalies, a random seed is used if not set
+	Schema string         `yaml:"schema"` // JSON file listing the fields of the metrics, relative to the scenario file. The header of every file is used if empty
+	Hosts  []ScenarioHost `yaml:"hosts"`  // The simulated hosts
+
+	schema *system_metrics.Schema // The schema read from the schema file, nil if the scenario has none
+}
+
+// ScenarioHost is a simulated host in a Scenario.
+type ScenarioHost struct {
+	Name     string            `yaml:"name"`     // Name of the host in the database, the name of the first file is used if empty
+	Segments []ScenarioSegment `yaml:"segments"` // The segments of the timeline of the host in chronological order
+}
+
+// ScenarioSegment is a part of the timeline of a ScenarioHost.
+// The start-at and duration fields work like the flags of the fill command and the anomalies like the anomaly flags.
+type ScenarioSegment struct {
+	File        string   `yaml:"file"`        // The CSV file to read the metrics from, relative to the scenario file
+	StartAt     string   `yaml:"start-at"`    // How far into the file the segment starts. Duration string
+	Duration    string   `yaml:"duration"`    // How long the segment is, until the end of the file if empty. Duration string
+	Anomalies   []string `yaml:"anomalies"`   // Anomaly specs applied in order to the segment, windows are relative to the segment
+	Expressions []string `yaml:"expressions"` // Anomaly expressions applied in order to the whole segment after the anomalies
+}
+
+// LoadScenario reads a scenario from a YAML or JSON file and validates it.
+// Relative file paths in the scenario are resolved relative to the directory of the scenario file.
+// Returns an error if the file can not be read or if the scenario is invalid.
+func LoadScenario(filePath string) (*Scenario, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// YAML is a superset of JSON so both formats can be parsed by the YAML parser
+	scenario := Scenario{}
+	if err := yaml.Unmarshal(content, &scenario); err != nil {
+		return nil, fmt.Errorf("invalid scenario file %s: %v", filePath, err)
+	}
+
+	if _, err := influxdbapi.ParseDurationString(scenario.Gap); err != nil {
+		return nil, err
+	}
+	if scenario.Schema != "" {
+		if !filepath.IsAbs(scenario.Schema) {
+			scenario.Schema = filepath.Join(filepath.Dir(filePath), scenario.Schema)
+		}
+		if scenario.schema, err = system_metrics.ReadSchemaFile(scenario.Schema); err != nil {
+			return nil, err
+		}
+	}
+	if len(scenario.Hosts) == 0 {
+		return nil, fmt.Errorf("scenario %s does not contain any hosts", filePath)
+	}
+	for i := range scenario.Hosts {
+		host := &scenario.Hosts[i]
+		if len(host.Segments) == 0 {
+			return nil, fmt.Errorf("host %d of scenario %s does not contain any segments", i+1, filePath)
+		}
+		for j := range host.Segments {
+			segment := &host.Segments[j]
+			if segment.File == "" {
+				return nil, fmt.Errorf("segment %d of host %d of scenario %s is missing a file", j+1, i+1, filePath)
+			}
+			if !filepath.IsAbs(segment.File) {
+				segment.File = filepath.Join(filepath.Dir(filePath), segment.File)
+			}
+			if err := ValidateFile(segment.File); err != nil {
+				return nil, err
+			}
+			if _, err := influxdbapi.ParseDurationString(segment.StartAt); err != nil {
+				return nil, err
+			}
+			if _, err := influxdbapi.ParseDurationString(segment.Duration); err != nil {
+				return nil, err
+			}
+			if _, err := checkAnomalyStrings(segment.Anomalies); err != nil {
+				return nil, err
+			}
+			if _, err := checkExpressionStrings(segment.Expressions); err != nil {
+				return nil, err
+			}
+		}
+		if host.Name == "" {
+			host.Name = GetIdFromFileName(host.Segments[0].File)
+		}
+	}
+
+	return &scenario, nil
+}
+
+// RunScenario simulates every host of the scenario in parallel.
+// The segments of a host are read, sliced and injected with their anomalies like the fill command does.
+// They are then written back-to-back so that the last segment ends gap time before now.
+// If stream is set, the segments before the last one end now and the last segment is streamed in real time.
+// Returns the first error that occurs for any of the hosts.
+func RunScenario(flags ScenarioArgs) error {
+	// Initialize the influxdb api
+	var influxDBApi = influxdbapi.NewInfluxDBApi(flags.DBArgs.Token, flags.DBArgs.Host, flags.DBArgs.Port, flags.DBArgs.Org, flags.DBArgs.Bucket, flags.DBArgs.Measurement)
+	defer influxDBApi.Close()
+
+	log.Printf("Running scenario with %v hosts and seed %v\n", len(flags.Scenario.Hosts), flags.Seed)
+
+	// The wait group is used to wait for all goroutines to finish
+	var wg sync.WaitGroup
+	// The errors of the goroutines are collected in a channel with room for one error per host so no goroutine blocks
+	errs := make(chan error, len(flags.Scenario.Hosts))
+
+	for _, host := range flags.Scenario.Hosts {
+		wg.Add(1)
+
+		go func(host ScenarioHost) {
+			defer wg.Done()
+			if err := runScenarioHost(influxDBApi, flags, host); err != nil {
+				errs <- fmt.Errorf("%s: %v", host.Name, err)
+			}
+		}(host)
+	}
+	wg.Wait()
+	close(errs)
+
+	// Return the first error if there is one
+	if err, failed := <-errs; failed {
+		return err
+	}
+	log.Println("Finished running scenario")
+	return nil
+}
+
+// runScenarioHost simulates the segments of a single host of a scenario.
+func runScenarioHost(api influxdbapi.InfluxDBApi, flags ScenarioArgs, host ScenarioHost) error {
+	gap, _ := influxdbapi.ParseDurationString(flags.Scenario.Gap)
+
+	// The last segment is not filled if it is streamed
+	filled := host.Segments
+	if flags.Stream {
+		filled = host.Segments[:len(host.Segments)-1]
+		gap = 0
+	}
+
+	// Read and slice the filled segments, their lengths are needed to know where the first segment starts
+	segments := make([]*system_metrics.SystemMetric, len(filled))
+	lengths := make([]time.Duration, len(filled))
+	var total time.Duration
+	for i, segment := range filled {
+		startAt, _ := influxdbapi.ParseDurationString(segment.StartAt)
+		duration, _ := influxdbapi.ParseDurationString(segment.Duration)
+
+		metrics, err := system_metrics.ReadFromFile(segment.File, host.Name, flags.Scenario.schema)
+		if err != nil {
+			return err
+		}
+		if err := metrics.SliceBetween(startAt, duration); err != nil {
+			return fmt.Errorf("segment %d does not contain any metrics: %v", i+1, err)
+		}
+		segments[i] = metrics
+
+		// If the segment lasts until the end of the file, it ends one sampling interval after the last metric
+		// A duration longer than the file is cut to the file so the next segment follows right after the last metric
+		last := metrics.Metrics[len(metrics.Metrics)-1].Timestamp
+		interval := int64(0)
+		if len(metrics.Metrics) > 1 {
+			interval = last - metrics.Metrics[len(metrics.Metrics)-2].Timestamp
+		}
+		lengths[i] = time.Duration(last+interval)*time.Second - startAt
+		if duration != 0 && duration < lengths[i] {
+			lengths[i] = duration
+		}
+		total += lengths[i]
+	}
+
+	// The segments are laid out back-to-back, segmentStart is the time the current segment starts at
+	segmentStart := time.Now().Add(-gap - total)
+	for i, segment := range filled {
+		startAt, _ := influxdbapi.ParseDurationString(segment.StartAt)
+		metrics := segments[i]
+
+		// The relative timestamps of the metrics are translated so that the start of the segment is at segmentStart
+		start := segmentStart.Add(-startAt)
+
+		// Every segment gets its own random source so the segments do not depend on each other
+		truths, err := InjectAnomalies(metrics, segment.Anomalies, segment.Expressions, 0, 0, start, NewRand(flags.Seed, fmt.Sprintf("%s/%d", host.Name, i)))
+		if err != nil {
+			return err
+		}
+		if len(segment.Anomalies)+len(segment.Expressions) > 0 {
+			if err := validateMetrics(metrics, truths, flags.Validate); err != nil {
+				return err
+			}
+		}
+
+		log.Printf("%v: writing segment %d from %v\n", host.Name, i+1, segmentStart.Format(time.RFC3339))
+		// The ground truth is only written for metrics that are in the database
+		if err := api.WriteMetricsFrom(*metrics, start, func() {}); err != nil {
+			return fmt.Errorf("segment %d: %v", i+1, err)
+		}
+		for _, truth := range truths {
+			if err := writeGroundTruth(api, truth, host.Name, start, flags.Seed); err != nil {
+				return err
+			}
+		}
+		segmentStart = segmentStart.Add(lengths[i])
+	}
+
+	if !flags.Stream {
+		return nil
+	}
+
+	// Stream the last segment starting now, right after the filled segments
+	last := host.Segments[len(host.Segments)-1]
+	startAt, _ := influxdbapi.ParseDurationString(last.StartAt)
+	duration, _ := influxdbapi.ParseDurationString(last.Duration)
+	log.Printf("%v: streaming segment %d\n", host.Name, len(host.Segments))
+	return Stream(StreamArgs{
+		DBArgs:         flags.DBArgs,
+		Duration:       duration,
+		StartAt:        startAt,
+		TimeMultiplier: 1,
+		Anomalies:      last.Anomalies,
+		AnomalyExprs:   last.Expressions,
+		Seed:           flags.Seed,
+		Validate:       flags.Validate,
+		Schema:         flags.Scenario.schema,
+		File:           last.File,
+		Id:             host.Name,
+	})
+}
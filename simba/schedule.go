@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"internal/influxdbapi"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedules make an anomaly recur, like a nightly backup or an hourly cron job.
+// A schedule is resolved against the absolute times the metrics are written at, in the local time zone, so an anomaly
+// scheduled at 02:00 happens at 02:00 in the written data no matter where in the file the simulation starts.
+// Two formats are supported:
+//   - Intervals on the form "every <period> [at <offset>]", e.g. "every 24h at 02:00" or "every 1h at 00:15".
+//     The period must divide a day or be a whole number of days. Periods shorter than a day restart at midnight and
+//     the offset is the time of day of the first occurrence, periods of several days count the days from 1970-01-01.
+//   - Cron expressions with five fields, minute hour day-of-month month day-of-week, e.g. "0 2 * * *".
+//     The fields accept *, numbers, ranges (1-5), steps (*/15 or 1-30/2) and lists (1,15). Day of week 0 and 7 are Sunday.
+//     The shorthands @hourly, @daily, @midnight, @weekly and @monthly are also accepted.
+
+// Schedule is a set of points in time an anomaly starts at.
+type Schedule interface {
+	// Next returns the first time of the schedule strictly after the given time, the zero time if there is none
+	Next(after time.Time) time.Time
+}
+
+// scheduleSearchLimit is how far ahead a schedule looks for its next time before it gives up, e.g. for February 30
+const scheduleSearchLimit = 5 * 366 * 24 * time.Hour
+
+// oneDay is the length of a day, the periods of interval schedules are checked against it
+const oneDay = 24 * time.Hour
+
+// cronShorthands are the cron expressions the shorthands stand for
+var cronShorthands = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+// ParseSchedule parses an interval schedule or a cron expression, see the formats above.
+// Returns an error if the schedule is malformed.
+func ParseSchedule(schedule string) (Schedule, error) {
+	schedule = strings.TrimSpace(schedule)
+	if expression, exists := cronShorthands[schedule]; exists {
+		schedule = expression
+	}
+	if strings.HasPrefix(schedule, "every ") {
+		return parseIntervalSchedule(strings.TrimPrefix(schedule, "every "))
+	}
+	return parseCronSchedule(schedule)
+}
+
+// Occurrences returns the times of the schedule from (inclusive) until to (inclusive) in chronological order.
+func Occurrences(schedule Schedule, from, to time.Time) []time.Time {
+	times := []time.Time{}
+	for t := schedule.Next(from.Add(-time.Nanosecond)); !t.IsZero() && !t.After(to); t = schedule.Next(t) {
+		times = append(times, t)
+	}
+	return times
+}
+
+// intervalSchedule is a schedule that recurs every period, see the formats above.
+type intervalSchedule struct {
+	period time.Duration // Time between the occurrences
+	offset time.Duration // Time of day of the first occurrence of a day
+}
+
+// parseIntervalSchedule parses the part of an interval schedule after "every"
+func parseIntervalSchedule(schedule string) (Schedule, error) {
+	periodString, offsetString, hasOffset := strings.Cut(schedule, " at ")
+	period, err := parseWindowDuration(strings.TrimSpace(periodString))
+	if err != nil || period <= 0 {
+		return nil, fmt.Errorf("invalid period '%s' in schedule, must be a positive duration", periodString)
+	}
+	if oneDay%period != 0 && period%oneDay != 0 {
+		return nil, fmt.Errorf("invalid period '%s' in schedule, must divide a day or be a whole number of days", periodString)
+	}
+
+	var offset time.Duration
+	if hasOffset {
+		if offset, err = parseTimeOfDay(strings.TrimSpace(offsetString)); err != nil {
+			return nil, err
+		}
+	}
+	// Periods shorter than a day repeat within the day, so only the offset into the period matters
+	if period < oneDay {
+		offset %= period
+	}
+	return intervalSchedule{period: period, offset: offset}, nil
+}
+
+// parseTimeOfDay parses a time of day on the form 15:04 or 15:04:05, or a duration into the day such as 2h30m
+func parseTimeOfDay(value string) (time.Duration, error) {
+	for _, layout := range []string{"15:04", "15:04:05"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second, nil
+		}
+	}
+	if d, err := influxdbapi.ParseDurationString(value); err == nil && d < oneDay {
+		return d, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 && d < oneDay {
+		return d, nil
+	}
+	return 0, fmt.Errorf("invalid offset '%s' in schedule, must be a time of day such as 02:00", value)
+}
+
+// Next returns the first occurrence after the given time
+func (s intervalSchedule) Next(after time.Time) time.Time {
+	local := after.In(time.Local)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.Local)
+
+	for i := 0; i < int(scheduleSearchLimit/oneDay); i++ {
+		next := time.Date(midnight.Year(), midnight.Month(), midnight.Day()+1, 0, 0, 0, 0, time.Local)
+		if s.period >= oneDay {
+			// Count the days since 1970-01-01 so every day of the period is the same no matter when the search starts
+			days := time.Date(midnight.Year(), midnight.Month(), midnight.Day(), 0, 0, 0, 0, time.UTC).Unix() / int64(oneDay.Seconds())
+			if t := midnight.Add(s.offset); days%int64(s.period/oneDay) == 0 && t.After(after) {
+				return t
+			}
+		} else {
+			for t := midnight.Add(s.offset); t.Before(next); t = t.Add(s.period) {
+				if t.After(after) {
+					return t
+				}
+			}
+		}
+		midnight = next
+	}
+	return time.Time{}
+}
+
+// cronSchedule is a schedule given as a cron expression, the fields are sets of the allowed values.
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays map[int]bool
+	anyDay, anyWeekday                     bool // Whether the day of month and day of week fields start with *
+}
+
+// cronFields are the names and ranges of the fields of a cron expression in order
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseCronSchedule parses a cron expression with five fields
+func parseCronSchedule(schedule string) (Schedule, error) {
+	fields := strings.Fields(schedule)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid schedule '%s', must be 'every <period> [at <offset>]' or a cron expression with five fields", schedule)
+	}
+
+	sets := make([]map[int]bool, len(fields))
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s '%s' in schedule: %v", cronFields[i].name, field, err)
+		}
+		sets[i] = set
+	}
+	// Like cron, both 0 and 7 are Sunday
+	if sets[4][7] {
+		delete(sets[4], 7)
+		sets[4][0] = true
+	}
+	return cronSchedule{
+		minutes:    sets[0],
+		hours:      sets[1],
+		days:       sets[2],
+		months:     sets[3],
+		weekdays:   sets[4],
+		anyDay:     strings.HasPrefix(fields[2], "*"),
+		anyWeekday: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// parseCronField parses a comma separated list of *, numbers, ranges and steps into the set of values it allows
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	set := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step < 1 {
+				return nil, fmt.Errorf("step must be a positive number")
+			}
+		}
+
+		low, high := min, max
+		if rangePart != "*" {
+			lowPart, highPart, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if low, err = strconv.Atoi(lowPart); err != nil {
+				return nil, fmt.Errorf("'%s' is not a number", lowPart)
+			}
+			high = low
+			if isRange {
+				if high, err = strconv.Atoi(highPart); err != nil {
+					return nil, fmt.Errorf("'%s' is not a number", highPart)
+				}
+			} else if hasStep {
+				// A single value with a step, e.g. 5/15, lasts until the end of the range
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return nil, fmt.Errorf("values must be between %d and %d", min, max)
+		}
+		for v := low; v <= high; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// Next returns the first minute after the given time that matches the cron expression
+func (s cronSchedule) Next(after time.Time) time.Time {
+	t := after.In(time.Local).Truncate(time.Minute).Add(time.Minute)
+	limit := after.Add(scheduleSearchLimit)
+	for t.Before(limit) {
+		switch {
+		case !s.months[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.Local)
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.Local)
+		case !s.hours[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, time.Local)
+		case !s.minutes[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// matchesDay returns whether the day of t matches the expression.
+// Like cron, if both the day of month and the day of week are restricted, a day matching either of them matches.
+func (s cronSchedule) matchesDay(t time.Time) bool {
+	monthDay, weekday := s.days[t.Day()], s.weekdays[int(t.Weekday())]
+	switch {
+	case s.anyDay && s.anyWeekday:
+		return true
+	case s.anyDay:
+		return weekday
+	case s.anyWeekday:
+		return monthDay
+	default:
+		return monthDay || weekday
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		want     []int
+		wantErr  bool
+	}{
+		{field: "*", min: 1, max: 5, want: []int{1, 2, 3, 4, 5}},
+		{field: "3", min: 0, max: 59, want: []int{3}},
+		{field: "1-4", min: 0, max: 59, want: []int{1, 2, 3, 4}},
+		{field: "*/15", min: 0, max: 59, want: []int{0, 15, 30, 45}},
+		{field: "1-10/3", min: 0, max: 59, want: []int{1, 4, 7, 10}},
+		{field: "50/5", min: 0, max: 59, want: []int{50, 55}},
+		{field: "1,15,30", min: 1, max: 31, want: []int{1, 15, 30}},
+		{field: "1-3,10-12/2,20", min: 1, max: 31, want: []int{1, 2, 3, 10, 12, 20}},
+		{field: "2,2,1-2", min: 0, max: 6, want: []int{1, 2}},
+		{field: "60", min: 0, max: 59, wantErr: true},
+		{field: "0", min: 1, max: 31, wantErr: true},
+		{field: "5-1", min: 0, max: 59, wantErr: true},
+		{field: "1-60", min: 0, max: 59, wantErr: true},
+		{field: "*/0", min: 0, max: 59, wantErr: true},
+		{field: "*/-1", min: 0, max: 59, wantErr: true},
+		{field: "*/x", min: 0, max: 59, wantErr: true},
+		{field: "a", min: 0, max: 59, wantErr: true},
+		{field: "1-", min: 0, max: 59, wantErr: true},
+		{field: "1,,2", min: 0, max: 59, wantErr: true},
+		{field: "", min: 0, max: 59, wantErr: true},
+	}
+	for _, test := range tests {
+		set, err := parseCronField(test.field, test.min, test.max)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseCronField(%q, %d, %d) error = %v, want error %v", test.field, test.min, test.max, err, test.wantErr)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		got := []int{}
+		for v := range set {
+			got = append(got, v)
+		}
+		sort.Ints(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseCronField(%q, %d, %d) = %v, want %v", test.field, test.min, test.max, got, test.want)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, schedule := range []string{
+		"",
+		"0 2 * *",
+		"0 2 * * * *",
+		"60 2 * * *",
+		"0 24 * * *",
+		"0 2 32 * *",
+		"0 2 * 13 *",
+		"0 2 * * 8",
+		"@yearly",
+		"every",
+		"every 0h",
+		"every -1h",
+		"every 7m",
+		"every 5h",
+		"every 36h",
+		"every 1x",
+		"every 24h at 25:00",
+		"every 24h at noon",
+		"every 24h at 1d",
+	} {
+		if _, err := ParseSchedule(schedule); err == nil {
+			t.Errorf("ParseSchedule(%q) succeeded, want error", schedule)
+		}
+	}
+}
+
+// date returns the local time of a date on the form 2006-01-02 15:04
+func date(t *testing.T, value string) time.Time {
+	d, err := time.ParseInLocation("2006-01-02 15:04", value, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestOccurrences(t *testing.T) {
+	// 2024-01-01 is a Monday
+	tests := []struct {
+		schedule string
+		from, to string
+		want     []string
+	}{
+		// Cron expressions
+		{schedule: "0 2 * * *", from: "2024-01-01 00:00", to: "2024-01-03 23:59", want: []string{"2024-01-01 02:00", "2024-01-02 02:00", "2024-01-03 02:00"}},
+		{schedule: "0 2 * * *", from: "2024-01-01 02:00", to: "2024-01-02 02:00", want: []string{"2024-01-01 02:00", "2024-01-02 02:00"}},
+		{schedule: "*/20 9-10 * * *", from: "2024-01-01 00:00", to: "2024-01-01 23:59", want: []string{"2024-01-01 09:00", "2024-01-01 09:20", "2024-01-01 09:40", "2024-01-01 10:00", "2024-01-01 10:20", "2024-01-01 10:40"}},
+		{schedule: "30 23 * * *", from: "2024-01-31 23:31", to: "2024-02-01 23:30", want: []string{"2024-02-01 23:30"}},
+		{schedule: "0 0,12 * * 1-5", from: "2024-01-05 06:00", to: "2024-01-08 06:00", want: []string{"2024-01-05 12:00", "2024-01-08 00:00"}},
+		{schedule: "0 0 1,15 * *", from: "2024-01-01 00:00", to: "2024-02-29 00:00", want: []string{"2024-01-01 00:00", "2024-01-15 00:00", "2024-02-01 00:00", "2024-02-15 00:00"}},
+		{schedule: "0 0 29 2 *", from: "2023-01-01 00:00", to: "2024-12-31 00:00", want: []string{"2024-02-29 00:00"}},
+		{schedule: "0 0 30 2 *", from: "2024-01-01 00:00", to: "2024-12-31 00:00", want: []string{}},
+		{schedule: "0 0 * 3-4/1 *", from: "2024-02-28 00:00", to: "2024-03-02 00:00", want: []string{"2024-03-01 00:00", "2024-03-02 00:00"}},
+
+		// Day of week 0 and 7 are both Sunday
+		{schedule: "0 0 * * 0", from: "2024-01-01 00:00", to: "2024-01-14 23:59", want: []string{"2024-01-07 00:00", "2024-01-14 00:00"}},
+		{schedule: "0 0 * * 7", from: "2024-01-01 00:00", to: "2024-01-14 23:59", want: []string{"2024-01-07 00:00", "2024-01-14 00:00"}},
+		{schedule: "0 0 * * 5-7", from: "2024-01-01 00:00", to: "2024-01-07 23:59", want: []string{"2024-01-05 00:00", "2024-01-06 00:00", "2024-01-07 00:00"}},
+		{schedule: "@weekly", from: "2024-01-01 00:00", to: "2024-01-14 23:59", want: []string{"2024-01-07 00:00", "2024-01-14 00:00"}},
+
+		// When both day of month and day of week are restricted, either matches
+		{schedule: "0 0 13 * 5", from: "2024-01-01 00:00", to: "2024-01-31 23:59", want: []string{"2024-01-05 00:00", "2024-01-12 00:00", "2024-01-13 00:00", "2024-01-19 00:00", "2024-01-26 00:00"}},
+		{schedule: "0 0 * * 5", from: "2024-01-01 00:00", to: "2024-01-14 23:59", want: []string{"2024-01-05 00:00", "2024-01-12 00:00"}},
+		{schedule: "0 0 13 * *", from: "2024-01-01 00:00", to: "2024-01-31 23:59", want: []string{"2024-01-13 00:00"}},
+		{schedule: "0 0 */10 * 1", from: "2024-01-01 00:00", to: "2024-01-10 23:59", want: []string{"2024-01-01 00:00", "2024-01-08 00:00"}},
+
+		// Intervals
+		{schedule: "every 24h at 02:00", from: "2024-01-01 03:00", to: "2024-01-03 02:00", want: []string{"2024-01-02 02:00", "2024-01-03 02:00"}},
+		{schedule: "every 1d at 2h30m", from: "2024-01-01 00:00", to: "2024-01-01 23:59", want: []string{"2024-01-01 02:30"}},
+		{schedule: "every 6h", from: "2024-01-01 00:00", to: "2024-01-01 23:59", want: []string{"2024-01-01 00:00", "2024-01-01 06:00", "2024-01-01 12:00", "2024-01-01 18:00"}},
+		{schedule: "every 1h at 00:15", from: "2024-01-01 10:00", to: "2024-01-01 12:00", want: []string{"2024-01-01 10:15", "2024-01-01 11:15"}},
+		{schedule: "every 90m", from: "2024-01-01 21:00", to: "2024-01-02 01:30", want: []string{"2024-01-01 21:00", "2024-01-01 22:30", "2024-01-02 00:00", "2024-01-02 01:30"}},
+
+		// Periods shorter than a day restart at midnight, the offset is the time of the first occurrence of a day
+		{schedule: "every 8h at 04:00", from: "2024-01-01 21:00", to: "2024-01-02 12:00", want: []string{"2024-01-02 04:00", "2024-01-02 12:00"}},
+		{schedule: "every 6h at 23:00", from: "2024-01-01 00:00", to: "2024-01-01 23:59", want: []string{"2024-01-01 05:00", "2024-01-01 11:00", "2024-01-01 17:00", "2024-01-01 23:00"}},
+		{schedule: "every 12h at 11:00", from: "2024-01-01 23:00", to: "2024-01-02 11:00", want: []string{"2024-01-01 23:00", "2024-01-02 11:00"}},
+
+		// Periods of several days count the days since 1970-01-01, 2024-01-01 is day 19723
+		{schedule: "every 2d at 03:00", from: "2024-01-01 00:00", to: "2024-01-06 00:00", want: []string{"2024-01-02 03:00", "2024-01-04 03:00"}},
+		{schedule: "every 48h", from: "2024-01-01 00:00", to: "2024-01-05 00:00", want: []string{"2024-01-02 00:00", "2024-01-04 00:00"}},
+	}
+	for _, test := range tests {
+		schedule, err := ParseSchedule(test.schedule)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q) error = %v", test.schedule, err)
+			continue
+		}
+		got := []string{}
+		for _, occurrence := range Occurrences(schedule, date(t, test.from), date(t, test.to)) {
+			got = append(got, occurrence.Format("2006-01-02 15:04"))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Occurrences(%q, %s, %s) = %v, want %v", test.schedule, test.from, test.to, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	system_metrics "internal/system_metrics"
+	"math"
+	"strings"
+)
+
+// Injected anomalies can leave the metrics in a state that is physically impossible, e.g. cpu-user at 1 while
+// cpu-system is still above 0, or more free memory than there is memory in total. Detectors trained on such data learn
+// the wrong thing, so the metrics are validated against the invariants of the fields of the dataset after injection.
+// Only the metrics inside the windows of the injected anomalies are validated, the rest are the recorded metrics and
+// are written as they are. Metrics with another schema are only checked against the invariants of the fields they have.
+
+// ValidationMode is what is done with metrics that violate an invariant after the anomalies are injected.
+type ValidationMode int
+
+const (
+	ValidateWarn  ValidationMode = iota // Log the violations and write the metrics as they are
+	ValidateFail                        // Return an error if any metric violates an invariant
+	ValidateClamp                       // Change the metrics as little as possible so they hold all invariants
+)
+
+// validationModeNames are the names of the validation modes as given to the validate flag
+var validationModeNames = map[ValidationMode]string{
+	ValidateWarn:  "warn",
+	ValidateFail:  "fail",
+	ValidateClamp: "clamp",
+}
+
+// String returns the name of the validation mode
+func (v ValidationMode) String() string {
+	return validationModeNames[v]
+}
+
+// ParseValidationMode returns the validation mode with the given name.
+// Returns an error if there is no validation mode with that name.
+func ParseValidationMode(name string) (ValidationMode, error) {
+	for mode, modeName := range validationModeNames {
+		if modeName == name {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid validation mode %s, must be one of warn, fail or clamp", name)
+}
+
+// invariant is a rule every metric must follow to be physically possible.
+// ref is the last metric before the anomaly window of the metric, which no anomaly changed. It is nil if the window
+// starts at the first metric.
+type invariant struct {
+	name  string                                   // Short description of the rule, shown when it is violated
+	holds func(m, ref *system_metrics.Metric) bool // Whether the metric follows the rule
+	clamp func(m, ref *system_metrics.Metric)      // Changes the metric so it follows the rule
+}
+
+// Violation is an invariant that is violated by one or more metrics of a series.
+type Violation struct {
+	Invariant string // Description of the violated rule
+	Count     int    // How many metrics violate the rule
+	First     int64  // Relative timestamp of the first metric that violates the rule
+}
+
+// String returns a human readable description of the violation
+func (v Violation) String() string {
+	return fmt.Sprintf("%d metrics violate '%s', the first at timestamp %d", v.Count, v.Invariant, v.First)
+}
+
+// fieldRanges are the lowest and highest possible value of the fields of the dataset.
+// The CPU fields are the fraction of the time spent in each state and server-up is either 0 or 1.
+// The temperature is the only field that can be negative.
+var fieldRanges = map[string][2]float64{
+	"load-1m":                 {0, math.Inf(1)},
+	"load-5m":                 {0, math.Inf(1)},
+	"load-15m":                {0, math.Inf(1)},
+	"sys-mem-swap-total":      {0, math.Inf(1)},
+	"sys-mem-swap-free":       {0, math.Inf(1)},
+	"sys-mem-free":            {0, math.Inf(1)},
+	"sys-mem-cache":           {0, math.Inf(1)},
+	"sys-mem-buffered":        {0, math.Inf(1)},
+	"sys-mem-available":       {0, math.Inf(1)},
+	"sys-mem-total":           {0, math.Inf(1)},
+	"sys-fork-rate":           {0, math.Inf(1)},
+	"sys-interrupt-rate":      {0, math.Inf(1)},
+	"sys-context-switch-rate": {0, math.Inf(1)},
+	"sys-thermal":             {math.Inf(-1), math.Inf(1)},
+	"disk-io-time":            {0, math.Inf(1)},
+	"disk-bytes-read":         {0, math.Inf(1)},
+	"disk-bytes-written":      {0, math.Inf(1)},
+	"disk-io-read":            {0, math.Inf(1)},
+	"disk-io-write":           {0, math.Inf(1)},
+	"cpu-iowait":              {0, 1},
+	"cpu-system":              {0, 1},
+	"cpu-user":                {0, 1},
+	"server-up":               {0, 1},
+}
+
+// invariants are checked in order, the ranges first so the sums only have to deal with values that are in range.
+var invariants = buildInvariants()
+
+// buildInvariants returns the invariants of the fields of the dataset
+func buildInvariants() []invariant {
+	result := []invariant{}
+
+	// Every field must be within its range
+	for _, field := range system_metrics.FieldNames() {
+		bounds := fieldRanges[field]
+		if math.IsInf(bounds[0], -1) && math.IsInf(bounds[1], 1) {
+			continue
+		}
+		name := fmt.Sprintf("%s must be at least %v", field, bounds[0])
+		if !math.IsInf(bounds[1], 1) {
+			name = fmt.Sprintf("%s must be between %v and %v", field, bounds[0], bounds[1])
+		}
+		result = append(result, rangeInvariant(name, field, bounds[0], bounds[1]))
+	}
+
+	// The total memory and swap of a host do not change, they are kept at the value before the anomaly
+	for _, field := range []string{"sys-mem-total", "sys-mem-swap-total"} {
+		result = append(result, constantInvariant(field))
+	}
+
+	// The parts of a whole can not add up to more than the whole
+	result = append(result,
+		sumInvariant([]string{"cpu-user", "cpu-system", "cpu-iowait"}, ""),
+		sumInvariant([]string{"sys-mem-free", "sys-mem-cache", "sys-mem-buffered"}, "sys-mem-total"),
+		sumInvariant([]string{"sys-mem-available"}, "sys-mem-total"),
+		sumInvariant([]string{"sys-mem-swap-free"}, "sys-mem-swap-total"),
+	)
+	return result
+}
+
+// rangeInvariant returns an invariant that keeps the field between min and max
+func rangeInvariant(name, field string, min, max float64) invariant {
+	return invariant{
+		name: name,
+		holds: func(m, _ *system_metrics.Metric) bool {
+			value, err := m.Get(field)
+			return err != nil || value >= min && value <= max
+		},
+		clamp: func(m, _ *system_metrics.Metric) {
+			value, _ := m.Get(field)
+			m.Set(field, math.Max(min, math.Min(value, max)))
+		},
+	}
+}
+
+// constantInvariant returns an invariant that keeps the field at its value in the reference metric before the
+// anomaly window. The anomalies never change the totals of a host, so a total that differs from the one before the
+// window was changed by an anomaly. When clamped, the field is set back to the value before the window.
+func constantInvariant(field string) invariant {
+	return invariant{
+		name: fmt.Sprintf("%s must keep its value from before the anomaly", field),
+		holds: func(m, ref *system_metrics.Metric) bool {
+			if ref == nil || !m.Schema.Has(field) || !ref.Schema.Has(field) {
+				return true
+			}
+			value, _ := m.Get(field)
+			return value == getField(ref, field)
+		},
+		clamp: func(m, ref *system_metrics.Metric) {
+			m.Set(field, getField(ref, field))
+		},
+	}
+}
+
+// sumInvariant returns an invariant that keeps the sum of the parts at most the value of the total field.
+// If total is empty, the parts are fractions and must add up to at most 1.
+// When clamped, the largest part is kept (the one an anomaly most likely pushed up) and the other parts shrink
+// proportionally to make room for it, the same way the anomalies share the CPU time between the CPU fields.
+func sumInvariant(parts []string, total string) invariant {
+	limit := func(m *system_metrics.Metric) float64 {
+		if total == "" {
+			return 1
+		}
+		value, _ := m.Get(total)
+		return value
+	}
+	name := fmt.Sprintf("%s must add up to at most 1", strings.Join(parts, " + "))
+	if total != "" {
+		name = fmt.Sprintf("%s must be at most %s", strings.Join(parts, " + "), total)
+	}
+
+	return invariant{
+		name: name,
+		holds: func(m, _ *system_metrics.Metric) bool {
+			for _, field := range append([]string{total}, parts...) {
+				if field != "" && !m.Schema.Has(field) {
+					return true
+				}
+			}
+			return sumFields(m, parts) <= limit(m)+1e-9
+		},
+		clamp: func(m, _ *system_metrics.Metric) {
+			largest := parts[0]
+			for _, part := range parts {
+				if getField(m, part) > getField(m, largest) {
+					largest = part
+				}
+			}
+			kept := math.Min(getField(m, largest), limit(m))
+			setFloor(m, largest, kept)
+
+			rest := sumFields(m, parts) - kept
+			if rest <= 0 {
+				return
+			}
+			scale := math.Max(limit(m)-kept, 0) / rest
+			for _, part := range parts {
+				if part != largest {
+					setFloor(m, part, getField(m, part)*scale)
+				}
+			}
+		},
+	}
+}
+
+// ValidateMetrics checks the metrics inside the windows of the injected anomalies against the invariants of the fields
+// of the dataset. The windows are the metrics labeled by the ground truth of the anomalies, see InjectAnomalies.
+// The invariants are checked in order as if every violation was clamped. If clamp is set, the metrics are changed to
+// hold the invariants, the metrics outside the windows are never changed.
+// Returns the violated invariants in the order they are checked, empty if all metrics are valid.
+func ValidateMetrics(metrics *system_metrics.SystemMetric, truths []GroundTruth, clamp bool) []Violation {
+	injected := map[int64]bool{}
+	for _, truth := range truths {
+		for _, label := range truth.Labels {
+			injected[label.Timestamp] = true
+		}
+	}
+
+	violations := make([]Violation, len(invariants))
+	var ref *system_metrics.Metric
+	for _, m := range metrics.Metrics {
+		if !injected[m.Timestamp] {
+			ref = m
+			continue
+		}
+		clamped := m.Copy()
+		for i, inv := range invariants {
+			if inv.holds(&clamped, ref) {
+				continue
+			}
+			if violations[i].Count == 0 {
+				violations[i].First = m.Timestamp
+			}
+			violations[i].Count++
+			inv.clamp(&clamped, ref)
+		}
+		if clamp {
+			*m = clamped
+		}
+	}
+
+	result := []Violation{}
+	for i, v := range violations {
+		if v.Count > 0 {
+			v.Invariant = invariants[i].name
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// sumFields returns the sum of the values of the fields
+func sumFields(m *system_metrics.Metric, fields []string) float64 {
+	sum := 0.0
+	for _, field := range fields {
+		sum += getField(m, field)
+	}
+	return sum
+}
+
+// getField returns the value of a field that is known to exist
+func getField(m *system_metrics.Metric, field string) float64 {
+	value, _ := m.Get(field)
+	return value
+}
+
+// setFloor sets a field that is known to exist, integer fields are rounded down instead of to the nearest integer
+// so a clamped sum never ends up above its limit
+func setFloor(m *system_metrics.Metric, field string, value float64) {
+	if m.Schema.IsInt(field) {
+		value = math.Floor(value)
+	}
+	m.Set(field, value)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"internal/system_metrics"
+	"testing"
+)
+
+// validationMetrics returns three metrics, the last two are in the window of an anomaly that pushed cpu-user above 1
+// and changed sys-mem-total
+func validationMetrics() (*system_metrics.SystemMetric, []GroundTruth) {
+	metrics := testMetrics(
+		map[string]float64{"cpu-user": 0.5, "cpu-system": 0.2, "sys-mem-total": 1000},
+		map[string]float64{"cpu-user": 1.2, "cpu-system": 0.2, "sys-mem-total": 1000},
+		map[string]float64{"cpu-user": 0.5, "cpu-system": 0.2, "sys-mem-total": 1001},
+	)
+	truths := []GroundTruth{{Anomaly: "test", Labels: []system_metrics.AnomalyDetectionOutput{
+		{Timestamp: 60},
+		{Timestamp: 120},
+	}}}
+	return metrics, truths
+}
+
+func TestValidateMetrics(t *testing.T) {
+	metrics, truths := validationMetrics()
+	violations := ValidateMetrics(metrics, truths, false)
+	want := []Violation{
+		{Invariant: "cpu-user must be between 0 and 1", Count: 1, First: 60},
+		{Invariant: "sys-mem-total must keep its value from before the anomaly", Count: 1, First: 120},
+		{Invariant: "cpu-user + cpu-system + cpu-iowait must add up to at most 1", Count: 1, First: 60},
+	}
+	if len(violations) != len(want) {
+		t.Fatalf("ValidateMetrics() = %v, want %v", violations, want)
+	}
+	for i := range want {
+		if violations[i] != want[i] {
+			t.Errorf("violation %d = %v, want %v", i, violations[i], want[i])
+		}
+	}
+
+	// The metrics outside the windows are not checked
+	if violations := ValidateMetrics(metrics, nil, false); len(violations) != 0 {
+		t.Errorf("ValidateMetrics() without ground truth = %v, want none", violations)
+	}
+}
+
+func TestValidationModes(t *testing.T) {
+	tests := []struct {
+		mode      ValidationMode
+		wantErr   bool
+		wantUser  float64 // cpu-user of the second metric after validation
+		wantTotal float64 // sys-mem-total of the third metric after validation
+	}{
+		{mode: ValidateWarn, wantUser: 1.2, wantTotal: 1001},
+		{mode: ValidateFail, wantErr: true, wantUser: 1.2, wantTotal: 1001},
+		{mode: ValidateClamp, wantUser: 1, wantTotal: 1000},
+	}
+	for _, test := range tests {
+		metrics, truths := validationMetrics()
+		err := validateMetrics(metrics, truths, test.mode)
+		if (err != nil) != test.wantErr {
+			t.Errorf("validateMetrics(%v) error = %v, want error %v", test.mode, err, test.wantErr)
+		}
+		if got := metrics.Metrics[1].Values["cpu-user"]; got != test.wantUser {
+			t.Errorf("validateMetrics(%v): cpu-user = %v, want %v", test.mode, got, test.wantUser)
+		}
+		if got := metrics.Metrics[2].Values["sys-mem-total"]; got != test.wantTotal {
+			t.Errorf("validateMetrics(%v): sys-mem-total = %v, want %v", test.mode, got, test.wantTotal)
+		}
+		if test.mode == ValidateClamp {
+			if violations := ValidateMetrics(metrics, truths, false); len(violations) != 0 {
+				t.Errorf("validateMetrics(%v) left violations %v", test.mode, violations)
+			}
+		}
+	}
+}